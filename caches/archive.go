@@ -0,0 +1,239 @@
+package caches
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Name of the member of an archive with the entries, in the layout of ENTRIES_FILE with their content inline
+const ARCHIVE_ENTRIES_FILE = "entries.json"
+
+// Compress the archive based on the extension of its path: `.zst` or `.zstd`
+// for zstd, `.gz` or `.tgz` for gzip and none otherwise.
+func newArchiveWriter(archivePath string, writer io.Writer) (io.WriteCloser, error) {
+	switch strings.ToLower(filepath.Ext(archivePath)) {
+	case ".zst", ".zstd":
+		return zstd.NewWriter(writer)
+	case ".gz", ".tgz":
+		return gzip.NewWriter(writer), nil
+	default:
+		return nopWriteCloser{writer}, nil
+	}
+}
+
+// Read the entries of the cache, both from the JSON and the entry files that
+// have not been consolidated yet. Expired entries are left out.
+func collectEntries(ctx context.Context, root string) (Entries, error) {
+	entries, err := readJson(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []entryFile{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() && isNamespacesDir(root, path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || isSymlink(info) || isCacheMetadata(root, path) || strings.HasSuffix(info.Name(), utils.TEMP_SUFFIX) {
+			return nil
+		}
+		if isEntryDigest(digestFromEntryPath(root, path)) {
+			files = append(files, entryFile{path: path, info: info})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := consolidateEntryFiles(ctx, root, entries, files, fsConfig.GetCompression()); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for digest, entry := range entries {
+		if entry.expired(now) {
+			delete(entries, digest)
+		}
+	}
+	return entries, nil
+}
+
+// Export writes the entries of the filesystem cache of `SetFsConfiguration()`
+// to a tar archive at archivePath, compressed based on its extension. The
+// archive holds a single ARCHIVE_ENTRIES_FILE, so it can be restored with
+// `Import()` wherever the cache lives and whatever its layout.
+func Export(ctx context.Context, archivePath string) error {
+	root, err := resolveCacheRoot(fsConfig.GetFileSystemCachePath())
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return fmt.Errorf("No cache in %s", root)
+	}
+
+	lock, err := lockEntries(root, false, fsConfig.GetFileMode())
+	if err != nil {
+		return err
+	}
+	entries, err := collectEntries(ctx, root)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entriesFile{Version: ENTRIES_VERSION, Entries: entries})
+	if err != nil {
+		return err
+	}
+
+	err = utils.WriteFileAtomicFunc(archivePath, fsConfig.GetFileMode(), func(file *os.File) error {
+		compressed, err := newArchiveWriter(archivePath, file)
+		if err != nil {
+			return err
+		}
+		archive := tar.NewWriter(compressed)
+		header := &tar.Header{
+			Name:    ARCHIVE_ENTRIES_FILE,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := archive.Write(data); err != nil {
+			return err
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+		return compressed.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Exported", len(entries), "cache entries from", root, "to", archivePath)
+	return nil
+}
+
+// Read the entries from an archive written by `Export()`, whatever its compression.
+func readArchive(archivePath string) (Entries, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decompressed, err := newDecompressReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
+
+	archive := tar.NewReader(decompressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("No %s in %s", ARCHIVE_ENTRIES_FILE, archivePath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", archivePath, err)
+		}
+		if header.Name != ARCHIVE_ENTRIES_FILE {
+			utils.Warnf("Skipping %s in %s", header.Name, archivePath)
+			continue
+		}
+
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", archivePath, err)
+		}
+		file := entriesFile{Entries: Entries{}}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("%s: %v", archivePath, err)
+		}
+		return file.Entries, nil
+	}
+}
+
+// Import merges the entries of an archive written by `Export()` into the
+// filesystem cache. Of the entries that are in both, the one that was used
+// last is kept. Entries that are corrupt or expired are skipped.
+func Import(ctx context.Context, archivePath string) error {
+	imported, err := readArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	root := fsConfig.GetFileSystemCachePath()
+	if err := utils.MkdirAllPerm(root, fsConfig.GetDirMode()); err != nil {
+		return err
+	}
+
+	fileMode := fsConfig.GetFileMode()
+	lock, err := lockEntries(root, true, fileMode)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	entries, err := readJsonForRewrite(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	added, kept, skipped := 0, 0, 0
+	changed := []string{}
+	for digest, entry := range imported {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !isEntryDigest(digest) || entry.expired(now) {
+			skipped++
+			continue
+		}
+		if _, err := entry.content(); err != nil {
+			utils.Warnf("Skipping cache entry %s: %v", digest, err)
+			skipped++
+			continue
+		}
+		if existing, exists := entries[digest]; exists && !existing.LastUsed.Before(entry.LastUsed) {
+			kept++
+			continue
+		}
+		entry.Pinned = entry.Pinned || entries[digest].Pinned
+		entries[digest] = entry
+		changed = append(changed, digest)
+		added++
+	}
+
+	if err := updateJson(root, entries, changed, nil, fileMode, fsConfig.IsEntriesLog()); err != nil {
+		return err
+	}
+
+	fmt.Println("Imported", added, "cache entries into", root, "keeping", kept, "existing entries that were used more recently")
+	if skipped > 0 {
+		fmt.Println("Skipped", skipped, "expired or invalid entries")
+	}
+	return nil
+}
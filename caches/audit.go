@@ -0,0 +1,65 @@
+package caches
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+const AUDIT_FILE = "events.jsonl"
+
+type Event struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Digest string    `json:"digest"`
+	Hit    bool      `json:"hit"`
+	Size   int       `json:"size"`
+}
+
+// IsAuditEnabled checks if cache events should be recorded, which the command
+// line tool enables when the CLANG_TIDY_CACHE_AUDIT environment variable is 1.
+func (cfg *FsConfiguration) IsAuditEnabled() bool {
+	return cfg.Audit
+}
+
+// RecordEvent appends the outcome of a cache lookup to the audit log in the
+// cache directory of `SetFsConfiguration()`, if it is enabled. Every event is a single line written
+// with one append, so concurrent processes do not interleave their events.
+func RecordEvent(target string, digest []byte, hit bool, size int) {
+	if !fsConfig.IsAuditEnabled() {
+		return
+	}
+
+	line, err := json.Marshal(Event{
+		Time:   time.Now(),
+		Target: target,
+		Digest: hex.EncodeToString(digest),
+		Hit:    hit,
+		Size:   size,
+	})
+	if err != nil {
+		utils.Warnf("Error encoding cache event: %v", err)
+		return
+	}
+
+	root := fsConfig.GetFileSystemCachePath()
+	if err := utils.MkdirAllPerm(root, fsConfig.GetDirMode()); err != nil {
+		utils.Warnf("Error writing cache event: %v", err)
+		return
+	}
+
+	f, err := utils.OpenFilePerm(filepath.Join(root, AUDIT_FILE), os.O_WRONLY|os.O_APPEND, fsConfig.GetFileMode())
+	if err != nil {
+		utils.Warnf("Error writing cache event: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		utils.Warnf("Error writing cache event: %v", err)
+	}
+}
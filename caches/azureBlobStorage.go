@@ -0,0 +1,118 @@
+package caches
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+type AzureConfiguration struct {
+	Container string `json:"container"`
+	// Connection string of the storage account, e.g. with an account key or a SAS token
+	ConnectionString string `json:"connection_string"`
+	// URL of the storage account, e.g. `https://<account>.blob.core.windows.net/`,
+	// used with the default Azure credentials such as a managed identity when
+	// there is no connection string
+	AccountUrl string `json:"account_url"`
+}
+
+type AzureBlobCache struct {
+	remoteSettings
+	cfg    *AzureConfiguration
+	client *azblob.Client
+}
+
+func NewAzureBlobCache(cfg *AzureConfiguration, settings *FsConfiguration) (*AzureBlobCache, error) {
+	var client *azblob.Client
+	var err error
+	if len(cfg.ConnectionString) > 0 {
+		client, err = azblob.NewClientFromConnectionString(cfg.ConnectionString, nil)
+	} else if len(cfg.AccountUrl) > 0 {
+		// the default credentials cover managed identities, the environment and the Azure CLI
+		credential, credErr := azidentity.NewDefaultAzureCredential(nil)
+		if credErr != nil {
+			return nil, credErr
+		}
+		client, err = azblob.NewClient(cfg.AccountUrl, credential, nil)
+	} else {
+		err = errors.New("Neither a connection string nor an account URL is configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &AzureBlobCache{
+		remoteSettings: newRemoteSettings(settings),
+		cfg:            cfg,
+		client:         client,
+	}
+
+	return cache, nil
+}
+
+// Any response of the storage account is an answer, e.g. when the credentials
+// only allow access to the blobs.
+func (c *AzureBlobCache) Ping(ctx context.Context) error {
+	_, err := c.client.ServiceClient().NewContainerClient(c.cfg.Container).GetProperties(ctx, nil)
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return nil
+	}
+	return err
+}
+
+// Blobs use the same names as the objects of the S3 cache. Errors, e.g. when
+// the storage account is throttling requests, are retried, then reported as
+// `ErrBackendUnavailable`.
+func (c *AzureBlobCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	name, err := c.defineObjectKey(digest)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var content []byte
+	found := false
+	err = c.withRetries(ctx, func() error {
+		response, err := c.client.DownloadStream(ctx, c.cfg.Container, name, nil)
+		if err != nil {
+			if bloberror.HasCode(err, bloberror.BlobNotFound) {
+				return nil
+			}
+			return err
+		}
+		defer response.Body.Close()
+
+		content, err = ioutil.ReadAll(response.Body)
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: Azure: %v", ErrBackendUnavailable, err)
+	}
+
+	return content, found, nil
+}
+
+// Entries are uploaded as block blobs, in blocks for large entries.
+func (c *AzureBlobCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	name, err := c.defineObjectKey(digest)
+	if err != nil {
+		return err
+	}
+
+	err = c.withRetries(ctx, func() error {
+		_, err := c.client.UploadBuffer(ctx, c.cfg.Container, name, content, nil)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: Azure: %v", ErrBackendUnavailable, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BatchCacher is implemented by caches that can store many entries at once,
+// e.g. to populate a new cache from the entries exported by another machine.
+type BatchCacher interface {
+	Cacher
+	// Store the entries, keyed by their hex encoded digest, in a single pass.
+	SaveEntries(ctx context.Context, entries map[string][]byte) error
+}
+
+// SaveEntries stores the entries, keyed by their hex encoded digest, in a
+// single pass when the cache is a BatchCacher and one by one otherwise.
+func SaveEntries(ctx context.Context, cache Cacher, entries map[string][]byte) error {
+	if batch, ok := cache.(BatchCacher); ok {
+		return batch.SaveEntries(ctx, entries)
+	}
+
+	digests, err := decodeEntryKeys(entries)
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := cache.SaveEntry(ctx, digest, entries[hex.EncodeToString(digest)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode the keys of the entries into digests, in a stable order. The keys
+// have to be in lower case, like the keys of lookups.
+func decodeEntryKeys(entries map[string][]byte) ([][]byte, error) {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		if !isEntryDigest(key) || key != strings.ToLower(key) {
+			return nil, fmt.Errorf("Invalid digest %q", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	digests := make([][]byte, len(keys))
+	for i, key := range keys {
+		digests[i], _ = hex.DecodeString(key)
+	}
+	return digests, nil
+}
@@ -0,0 +1,247 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Default name of the bbolt database, in the directory of the filesystem cache
+const BOLT_FILE = "entries.db"
+
+// How long to wait for other processes to release the database
+const BOLT_LOCK_TIMEOUT = 30 * time.Second
+
+var boltBucket = []byte("entries")
+
+type BoltConfiguration struct {
+	// Path of the database, defaults to `entries.db` in the cache directory
+	Path string `json:"path"`
+}
+
+// BoltCache stores all of the entries in a single bbolt database, keyed by
+// the hex digest, which avoids the many files of the filesystem cache. The
+// database can only be opened by one process at a time, so it is only kept
+// open for the duration of each operation.
+type BoltCache struct {
+	path        string
+	dirMode     os.FileMode
+	fileMode    os.FileMode
+	compression string
+}
+
+func getBoltPath(cfg *BoltConfiguration, settings *FsConfiguration) string {
+	if cfg != nil && len(cfg.Path) > 0 {
+		return cfg.Path
+	}
+	return filepath.Join(settings.GetFileSystemCachePath(), BOLT_FILE)
+}
+
+func NewBoltCache(cfg *BoltConfiguration, settings *FsConfiguration) *BoltCache {
+	return &BoltCache{
+		path:        getBoltPath(cfg, settings),
+		dirMode:     settings.GetDirMode(),
+		fileMode:    settings.GetFileMode(),
+		compression: settings.GetCompression(),
+	}
+}
+
+func openBoltDb(dbPath string, dirMode os.FileMode, fileMode os.FileMode) (*bolt.DB, error) {
+	if err := utils.MkdirAllPerm(filepath.Dir(dbPath), dirMode); err != nil {
+		return nil, err
+	}
+	return bolt.Open(dbPath, fileMode, &bolt.Options{Timeout: BOLT_LOCK_TIMEOUT})
+}
+
+// A hit updates the last used time of the entry. A database that can not be
+// opened, e.g. because another process holds it, is reported as
+// `ErrBackendUnavailable`, a corrupt entry as `ErrCorrupt`.
+func (c *BoltCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	db, err := openBoltDb(c.path, c.dirMode, c.fileMode)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: bbolt: %v", ErrBackendUnavailable, err)
+	}
+	defer db.Close()
+
+	var content []byte
+	found := false
+	key := []byte(hex.EncodeToString(digest))
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get(key)
+		if value == nil {
+			return nil
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		if content, err = entry.content(); err != nil {
+			return err
+		}
+		found = true
+
+		entry.LastUsed = time.Now()
+		value, err = json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, value)
+	})
+	if err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			return nil, false, err
+		}
+		return nil, false, fmt.Errorf("%w: bbolt: %v", ErrBackendUnavailable, err)
+	}
+
+	return content, found, nil
+}
+
+func (c *BoltCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	entry, err := newEntry(content, time.Now(), c.compression)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	db, err := openBoltDb(c.path, c.dirMode, c.fileMode)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hex.EncodeToString(digest)), value)
+	})
+}
+
+// SaveEntries stores the entries in a single transaction.
+func (c *BoltCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	digests, err := decodeEntryKeys(entries)
+	if err != nil {
+		return err
+	}
+
+	db, err := openBoltDb(c.path, c.dirMode, c.fileMode)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		for _, digest := range digests {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key := hex.EncodeToString(digest)
+			entry, err := newEntry(entries[key], now, c.compression)
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Prune the bbolt cache in a single transaction, with the same limits as
+// `Prune()`. Cancelling `ctx` rolls back the transaction.
+func PruneBolt(ctx context.Context, cfg *BoltConfiguration, settings *FsConfiguration, maxAge time.Duration, dryRun bool) error {
+	maxEntries, err := settings.GetMaxCacheEntries()
+	if err != nil {
+		return err
+	}
+	maxSize, err := settings.GetMaxCacheSize()
+	if err != nil {
+		return err
+	}
+
+	dbPath := getBoltPath(cfg, settings)
+	db, err := openBoltDb(dbPath, settings.GetDirMode(), settings.GetFileMode())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			fmt.Println("Found 0 cache entries in", dbPath)
+			return nil
+		}
+
+		// corrupt entries can never be read, so they are removed as well
+		entries := Entries{}
+		removedKeys := [][]byte{}
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var entry Entry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				utils.Warnf("Error decoding bbolt cache entry %s: %v", key, err)
+				removedKeys = append(removedKeys, append([]byte{}, key...))
+				return nil
+			}
+			// the entries do not share their content, so are sized separately
+			entry.Checksum = ""
+			entries[string(key)] = entry
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Found", len(entries), "cache entries in", dbPath)
+		prunedEntries := selectEntries(entries, maxAge, maxEntries, maxSize, dryRun)
+		if dryRun {
+			return nil
+		}
+
+		for key := range entries {
+			if _, kept := prunedEntries[key]; !kept {
+				removedKeys = append(removedKeys, []byte(key))
+			}
+		}
+		for _, key := range removedKeys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -1,29 +1,62 @@
 package caches
 
 import (
-	"crypto/sha256"
+	"context"
 	"github.com/ejfitzgerald/clang-tidy-cache/clang"
 	"github.com/ejfitzgerald/clang-tidy-cache/utils"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 )
 
 type Cacher interface {
-	// Find contents of cache entry specified by digest.
-	FindEntry(digest []byte) ([]byte, error)
-	// Store contents into a cache entry specified by digest.
-	SaveEntry(digest []byte, content []byte) error
+	// Find contents of cache entry specified by digest. The boolean tells if the entry was found, since the
+	// contents of an entry can be empty. Cancelling `ctx` aborts the lookup.
+	FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error)
+	// Store contents into a cache entry specified by digest. Cancelling `ctx` aborts the write.
+	SaveEntry(ctx context.Context, digest []byte, content []byte) error
 }
 
-func computeFileDigest(path string) ([]byte, error) {
+// Wrapper is implemented by the caches that wrap another cache to change how it is used, e.g. to skip saving entries.
+type Wrapper interface {
+	// Get the wrapped cache.
+	Unwrap() Cacher
+}
+
+// Unwrap removes the wrappers from the cache, see `Wrapper`, and returns the cache underneath.
+func Unwrap(cache Cacher) Cacher {
+	for {
+		wrapper, ok := cache.(Wrapper)
+		if !ok {
+			return cache
+		}
+		cache = wrapper.Unwrap()
+	}
+}
+
+// StreamCacher is implemented by caches that can stream the contents of entries, so that large entries do not
+// have to be held in memory.
+type StreamCacher interface {
+	Cacher
+	// Open the contents of the cache entry specified by digest, the reader has to be closed when found.
+	FindEntryReader(ctx context.Context, digest []byte) (io.ReadCloser, bool, error)
+	// Store the contents read from content into a cache entry specified by digest.
+	SaveEntryReader(ctx context.Context, digest []byte, content io.Reader) error
+}
+
+func computeFileDigest(path string, hashAlgorithm string) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	hasher := sha256.New()
+	hasher := utils.NewHashOf(hashAlgorithm)
 	if _, err := io.Copy(hasher, f); err != nil {
 		return nil, err
 	}
@@ -34,71 +67,261 @@ func computeFileDigest(path string) ([]byte, error) {
 	return digest, nil
 }
 
-func computeDigestForConfigFile(projectRoot string) ([]byte, error) {
-	configFilePath, err := utils.FindInParents(projectRoot, ".clang-tidy")
-	if err != nil {
-		return nil, err
+// Matches configuration files that are merged with the configuration of the parent directories
+var inheritParentConfig = regexp.MustCompile(`(?m)^\s*InheritParentConfig\s*:\s*(true|True|TRUE|yes|1)\s*$`)
+
+// Compute the digest of the configuration clang-tidy uses for the target, following the lookup rules of
+// clang-tidy: inline configuration first, then an explicit configuration file, and finally the `.clang-tidy`
+// file closest to the target plus those in its parents when it inherits their configuration.
+func computeDigestForConfig(invocation *clang.TidyInvocation, wd string, hashAlgorithm string) ([]byte, error) {
+	hasher := utils.NewHashOf(hashAlgorithm)
+
+	if invocation.Config != nil {
+		hasher.Write([]byte(*invocation.Config))
+		return hasher.Sum(nil), nil
+	}
+
+	if invocation.ConfigFile != nil {
+		digest, err := computeFileDigest(*invocation.ConfigFile, hashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		hasher.Write(digest)
+		return hasher.Sum(nil), nil
+	}
+
+	targetPath := invocation.TargetPath
+	if !filepath.IsAbs(targetPath) {
+		targetPath = filepath.Join(wd, targetPath)
+	}
+
+	searchDir := filepath.Dir(targetPath)
+	for {
+		configFilePath, err := utils.FindInParents(searchDir, ".clang-tidy")
+		if err != nil {
+			// no (further) configuration file: clang-tidy uses its defaults
+			break
+		}
+
+		content, err := ioutil.ReadFile(configFilePath)
+		if err != nil {
+			return nil, err
+		}
+		hasher.Write(content)
+
+		parentDir := filepath.Dir(filepath.Dir(configFilePath))
+		if !inheritParentConfig.Match(content) || parentDir == filepath.Dir(configFilePath) {
+			break
+		}
+		searchDir = parentDir
 	}
 
-	return computeFileDigest(configFilePath)
+	return hasher.Sum(nil), nil
 }
 
-func computeDigestForClangTidyBinary(clangTidyPath string) ([]byte, error) {
+func computeDigestForClangTidyBinary(clangTidyPath string, hashAlgorithm string) ([]byte, error) {
 	// resolve to a full path: e.g. `clang-tidy` -> `/usr/local/bin/clang-tidy`
 	path, err := exec.LookPath(clangTidyPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return computeFileDigest(path)
+	return computeFileDigest(path, hashAlgorithm)
+}
+
+// The version output only depends on the binary, so it is looked up once per process
+var clangTidyVersions = map[string][]byte{}
+var clangTidyVersionsLock sync.Mutex
+
+func computeDigestForClangTidyVersion(clangTidyPath string, hashAlgorithm string) ([]byte, error) {
+	clangTidyVersionsLock.Lock()
+	defer clangTidyVersionsLock.Unlock()
+
+	output, ok := clangTidyVersions[clangTidyPath]
+	if !ok {
+		// the binary digest does not change when clang-tidy is behind a wrapper script, the version output does
+		var err error
+		if output, err = exec.Command(clangTidyPath, "--version").Output(); err != nil {
+			return nil, err
+		}
+		clangTidyVersions[clangTidyPath] = output
+	}
+	return utils.HashOf(hashAlgorithm, output), nil
+}
+
+// FingerPrintParts are the digests that are combined into the fingerprint of
+// an invocation of clang-tidy.
+type FingerPrintParts struct {
+	// The preprocessed source, so it covers the headers and compiler flags as well
+	Preprocessed []byte
+	// The flags of the compile command that select the language standard, the
+	// standard library and the target, see `clang.CompilerCommand.TargetFlags()`.
+	// Empty when there are none.
+	Compile []byte
+	// The configuration of clang-tidy for the target
+	Config []byte
+	// The clang-tidy binary and its version output
+	Binary  []byte
+	Version []byte
+	// The arguments of clang-tidy other than the paths, with response files expanded
+	Arguments []byte
+	// Whether the result includes the exported fixes
+	ExportFixes bool
+	// The algorithm of the digests, see `utils.SetHashAlgorithm()`
+	Hash string
+}
+
+// Combine all the digests to generate a unique fingerprint. The fingerprints
+// differ from those of earlier versions, which did not cover the compile flags,
+// the version output and the arguments, so their entries are not found again.
+func (p *FingerPrintParts) Sum() []byte {
+	hashAlgorithm := p.Hash
+	if len(hashAlgorithm) == 0 {
+		hashAlgorithm = utils.DEFAULT_HASH
+	}
+	hasher := utils.NewHashOf(hashAlgorithm)
+	// only the algorithms other than the default one are named
+	if hashAlgorithm != utils.DEFAULT_HASH {
+		hasher.Write([]byte(p.Hash))
+	}
+	hasher.Write(p.Preprocessed)
+	// empty for commands without target flags
+	hasher.Write(p.Compile)
+
+	hasher.Write(p.Config)
+	hasher.Write(p.Binary)
+	hasher.Write(p.Version)
+	hasher.Write(p.Arguments)
+	// results without exported fixes can not be replayed for invocations that request them
+	if p.ExportFixes {
+		hasher.Write([]byte("export-fixes"))
+	}
+	return hasher.Sum(nil)
 }
 
-func ComputeFingerPrint(clangTidyPath string, baseDir string, invocation *clang.TidyInvocation,
-	wd string, args []string) ([]byte, error) {
+func ComputeFingerPrint(clangTidyPath string, baseDir string, ignoreWhitespace bool, invocation *clang.TidyInvocation,
+	wd string) ([]byte, error) {
 
+	parts, err := ComputeFingerPrintParts(clangTidyPath, baseDir, ignoreWhitespace, invocation, wd)
+	if err != nil {
+		return nil, err
+	}
+	return parts.Sum(), nil
+}
+
+// Compute the digests that make up the fingerprint of the invocation, see `ComputeFingerPrint()`. The digests use
+// the algorithm set by `utils.SetHashAlgorithm()`.
+func ComputeFingerPrintParts(clangTidyPath string, baseDir string, ignoreWhitespace bool, invocation *clang.TidyInvocation,
+	wd string) (*FingerPrintParts, error) {
+
+	return evaluateFingerPrintParts(clangTidyPath, baseDir, ignoreWhitespace, invocation, wd, utils.HashAlgorithm())
+}
+
+// ComputeStdinFingerPrint computes the fingerprint of an invocation that reads its source from stdin, see
+// `ComputeStdinFingerPrintParts()`.
+func ComputeStdinFingerPrint(clangTidyPath string, baseDir string, ignoreWhitespace bool, invocation *clang.TidyInvocation,
+	wd string, source []byte) ([]byte, error) {
+
+	parts, err := ComputeStdinFingerPrintParts(clangTidyPath, baseDir, ignoreWhitespace, invocation, wd, source)
+	if err != nil {
+		return nil, err
+	}
+	return parts.Sum(), nil
+}
+
+// Compute the digests that make up the fingerprint of an invocation that reads its source from stdin, `source` being
+// the content read from it. Without a file there is no compile command to preprocess, so the digest of the source
+// takes the place of the preprocessed one, and the headers it includes are not part of the fingerprint.
+func ComputeStdinFingerPrintParts(clangTidyPath string, baseDir string, ignoreWhitespace bool, invocation *clang.TidyInvocation,
+	wd string, source []byte) (*FingerPrintParts, error) {
+
+	hashAlgorithm := utils.HashAlgorithm()
+	sourceDigest := clang.DigestPreprocessed(source, baseDir, ignoreWhitespace, hashAlgorithm)
+	return computeFingerPrintParts(clangTidyPath, invocation, wd, sourceDigest, &clang.CompilerCommand{}, hashAlgorithm)
+}
+
+// Compute the digests that make up the fingerprint of the invocation with the named hash algorithm, running the
+// preprocessor of the compile command.
+func evaluateFingerPrintParts(clangTidyPath string, baseDir string, ignoreWhitespace bool, invocation *clang.TidyInvocation,
+	wd string, hashAlgorithm string) (*FingerPrintParts, error) {
+
+	directory, compileCommand, err := findCompileCommand(invocation)
+	if err != nil {
+		return nil, err
+	}
+
+	// main part of the fingerprint check generate the preprocessed output file and create a SHA256 of it
+	preProcessedDigest, err := clang.EvaluatePreprocessedFile(directory, baseDir, ignoreWhitespace, compileCommand, hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return computeFingerPrintParts(clangTidyPath, invocation, wd, preProcessedDigest, compileCommand, hashAlgorithm)
+}
+
+// Find the compile command of the target in the compilation database, or in
+// the one of the current directory, and the directory it runs in.
+func findCompileCommand(invocation *clang.TidyInvocation) (string, *clang.CompilerCommand, error) {
 	// extract the compilation target command flags from the database
 	targetFlags, err := clang.ExtractCompilationTarget(invocation.DatabaseRoot, invocation.TargetPath)
 	if err != nil {
 		cwd, wderr := os.Getwd()
 		if wderr != nil {
-			return nil, err
+			return "", nil, err
 		}
 		targetFlags, err = clang.ExtractCompilationTarget(cwd, invocation.TargetPath)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 	}
 
 	// parse the main clang flags
 	compileCommand, err := clang.ParseClangCommandString(targetFlags.Command)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
+	return targetFlags.Directory, compileCommand, nil
+}
 
-	// main part of the fingerprint check generate the preprocessed output file and create a SHA256 of it
-	preProcessedDigest, err := clang.EvaluatePreprocessedFile(targetFlags.Directory, baseDir, compileCommand)
-	if err != nil {
-		return nil, err
+// Compute the digests of the fingerprint other than that of the preprocessed source.
+func computeFingerPrintParts(clangTidyPath string, invocation *clang.TidyInvocation, wd string, preProcessedDigest []byte,
+	compileCommand *clang.CompilerCommand, hashAlgorithm string) (*FingerPrintParts, error) {
+
+	var compileDigest []byte
+	if flags := compileCommand.TargetFlags(); len(flags) > 0 {
+		compileDigest = utils.HashOf(hashAlgorithm, []byte(strings.Join(flags, "\x00")))
 	}
 
 	// generate a digest for the full configuration
-	configDigest, err := computeDigestForConfigFile(wd)
+	configDigest, err := computeDigestForConfig(invocation, wd, hashAlgorithm)
 	if err != nil {
 		return nil, err
 	}
 
 	// we also need to include the clang-tidy binary since different version have different output
-	binaryDigest, err := computeDigestForClangTidyBinary(clangTidyPath)
+	binaryDigest, err := computeDigestForClangTidyBinary(clangTidyPath, hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	versionDigest, err := computeDigestForClangTidyVersion(clangTidyPath, hashAlgorithm)
 	if err != nil {
 		return nil, err
 	}
 
-	// combine all the digests to generate a unique fingerprint
-	hasher := sha256.New()
-	hasher.Write(preProcessedDigest)
-	hasher.Write(configDigest)
-	hasher.Write(binaryDigest)
-	fingerPrint := hasher.Sum(nil)
+	// the options are separated by a NUL, which can not occur in an argument
+	argumentsDigest := utils.HashOf(hashAlgorithm, []byte(strings.Join(invocation.Options, "\x00")))
+
+	parts := &FingerPrintParts{
+		Preprocessed: preProcessedDigest,
+		Compile:      compileDigest,
+		Config:       configDigest,
+		Binary:       binaryDigest,
+		Version:      versionDigest,
+		Arguments:    argumentsDigest,
+		ExportFixes:  invocation.ExportFile != nil,
+		Hash:         hashAlgorithm,
+	}
 
-	return fingerPrint, nil
+	return parts, nil
 }
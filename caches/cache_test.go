@@ -0,0 +1,58 @@
+package caches
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/clang"
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+func TestFingerPrintSumCoversCompile(t *testing.T) {
+	parts := func(compile []byte) *FingerPrintParts {
+		return &FingerPrintParts{
+			Preprocessed: utils.HashOf(utils.DEFAULT_HASH, []byte("int main() { return 0; }")),
+			Compile:      compile,
+			Config:       utils.HashOf(utils.DEFAULT_HASH, []byte("Checks: '-*,bugprone-*'")),
+			Binary:       utils.HashOf(utils.DEFAULT_HASH, []byte("clang-tidy")),
+			Version:      utils.HashOf(utils.DEFAULT_HASH, []byte("LLVM version 17.0.6")),
+			Arguments:    utils.HashOf(utils.DEFAULT_HASH, []byte("-checks=bugprone-*")),
+		}
+	}
+	cpp17 := parts(utils.HashOf(utils.DEFAULT_HASH, []byte("-std=c++17"))).Sum()
+	cpp20 := parts(utils.HashOf(utils.DEFAULT_HASH, []byte("-std=c++20"))).Sum()
+	none := parts(nil).Sum()
+
+	if bytes.Equal(cpp17, cpp20) {
+		t.Error("the fingerprints of -std=c++17 and -std=c++20 are the same")
+	}
+	if bytes.Equal(cpp17, none) {
+		t.Error("the fingerprints with and without target flags are the same")
+	}
+	if !bytes.Equal(none, parts([]byte{}).Sum()) {
+		t.Error("the fingerprint without target flags depends on how they are empty")
+	}
+}
+
+func TestStdinFingerPrint(t *testing.T) {
+	dir, clangTidy := setupDigestProject(t)
+	invocation, err := clang.ParseTidyCommand([]string{"-checks=bugprone-*", "-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerPrint := func(source string) []byte {
+		digest, err := ComputeStdinFingerPrint(clangTidy, "", false, invocation, dir, []byte(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+
+	first := fingerPrint("int a;\n")
+	if !bytes.Equal(first, fingerPrint("int a;\n")) {
+		t.Error("the fingerprints of the same source differ")
+	}
+	if bytes.Equal(first, fingerPrint("int b;\n")) {
+		t.Error("the fingerprints of different sources are the same")
+	}
+}
@@ -0,0 +1,139 @@
+package caches
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// The zstd encoder and decoder are expensive to create but safe for concurrent
+// use, so they are shared by all (de)compressions.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr == nil {
+			zstdDecoder, zstdErr = zstd.NewReader(nil)
+		}
+	})
+	return zstdErr
+}
+
+// GetCompression gets the codec used for compressing new cache entries. It
+// defaults to zstd and can be overridden by setting `compression` in the
+// configuration, or CLANG_TIDY_CACHE_COMPRESSION, to none, gzip or zstd.
+func (cfg *FsConfiguration) GetCompression() string {
+	switch codec := cfg.Compression; codec {
+	case COMPRESSION_NONE, COMPRESSION_GZIP:
+		return codec
+	default:
+		return COMPRESSION_ZSTD
+	}
+}
+
+// Compress the content with the codec. Both codecs write their own
+// magic number at the start of the data, which is used by `decompress()` to
+// tell compressed and uncompressed entries apart.
+func compress(content []byte, codec string) ([]byte, error) {
+	switch codec {
+	case COMPRESSION_GZIP:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(content); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case COMPRESSION_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(content, nil), nil
+	default:
+		return content, nil
+	}
+}
+
+// Decompress the data based on its magic number. Data without a known magic
+// number was written uncompressed and is returned as is.
+func decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case bytes.HasPrefix(data, zstdMagic):
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return data, nil
+	}
+}
+
+// Wrap the reader to decompress the data based on its magic number, like
+// `decompress()`.
+func newDecompressReader(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+	magic, _ := buffered.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		// the shared decoder can not stream, so every stream gets its own
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(buffered), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Wrap the writer to compress the data with the codec, like `compress()`. The
+// data is only complete once the writer is closed.
+func newCompressWriter(writer io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(writer), nil
+	case COMPRESSION_ZSTD:
+		return zstd.NewWriter(writer)
+	default:
+		return nopWriteCloser{writer}, nil
+	}
+}
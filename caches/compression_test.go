@@ -0,0 +1,49 @@
+package caches
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Output of clang-tidy like that of a file with many warnings, which repeats a
+// lot like the real one.
+func benchmarkContent() []byte {
+	var content bytes.Buffer
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&content, "/src/project/lib/module%d.cpp:%d:5: warning: use auto when declaring iterators [modernize-use-auto]\n", i%20, i)
+		fmt.Fprintf(&content, "    std::vector<int>::iterator it = values.begin();\n    ^~~~~~~~~~~~~~~~~~~~~~~~~~~\n    auto\n")
+	}
+	return content.Bytes()
+}
+
+// Compress the content with the default codec, which is zstd, and with the
+// others, reporting the size of the compressed content as a ratio.
+func BenchmarkCompress(b *testing.B) {
+	content := benchmarkContent()
+	for _, compression := range []string{"", COMPRESSION_GZIP, COMPRESSION_NONE} {
+		codec := (&FsConfiguration{Compression: compression}).GetCompression()
+		name := codec
+		if len(compression) == 0 {
+			name += "-default"
+		}
+		b.Run(name, func(b *testing.B) {
+			compressed, err := compress(content, codec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if decompressed, err := decompress(compressed); err != nil || !bytes.Equal(decompressed, content) {
+				b.Fatalf("the content does not survive %s: %v", name, err)
+			}
+
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := compress(content, codec); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(compressed))/float64(len(content)), "ratio")
+		})
+	}
+}
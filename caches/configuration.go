@@ -0,0 +1,222 @@
+package caches
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Configuration selects the cache backend along with its settings. It is the
+// part of the configuration file of the command line tool that is about the
+// cache, so that other tools can embed the cache with the same settings.
+type Configuration struct {
+	Backend         string                  `json:"backend"`
+	Tiered          bool                    `json:"tiered"`
+	GcsConfig       *GcsConfiguration       `json:"gcs,omitempty"`
+	RedisConfig     *RedisConfiguration     `json:"redis,omitempty"`
+	MemcachedConfig *MemcachedConfiguration `json:"memcached,omitempty"`
+	S3Config        *S3Configuration        `json:"s3,omitempty"`
+	AzureConfig     *AzureConfiguration     `json:"azure,omitempty"`
+	HttpConfig      *HttpConfiguration      `json:"http,omitempty"`
+	BoltConfig      *BoltConfiguration      `json:"bolt,omitempty"`
+	SqliteConfig    *SqliteConfiguration    `json:"sqlite,omitempty"`
+	// the `cache_dir`, `compression`, `shard_depth`, `dir_mode`, `file_mode`, `prune`, `touch_interval`, `namespace`, `max_entry_size`, `remote_retries`, `read_only` and `store_rate` keys
+	FsConfiguration
+}
+
+// Pruner removes the entries of a cache that have not been used within maxAge,
+// or only reports them when dryRun is set.
+type Pruner interface {
+	Prune(ctx context.Context, maxAge time.Duration, dryRun bool) error
+}
+
+// PrunerFunc adapts a function to the Pruner interface.
+type PrunerFunc func(ctx context.Context, maxAge time.Duration, dryRun bool) error
+
+func (f PrunerFunc) Prune(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+	return f(ctx, maxAge, dryRun)
+}
+
+// New creates the cache described by the configuration along with the pruner
+// of its entries. A backend that can not be created is logged and replaced by
+// the filesystem cache, so that a cache is always available. When tracing is
+// enabled, the operations on the cache are recorded as spans. The cache and
+// the pruner keep a copy of the settings of the filesystem cache, so caches
+// with different configurations can be used side by side, and the environment
+// does not change them.
+func New(cfg *Configuration) (Cacher, Pruner) {
+	settings := cfg.FsConfiguration
+
+	maxEntrySize, err := settings.GetMaxEntrySize()
+	if err != nil {
+		utils.Warnf("%v, not limiting the size of entries", err)
+	}
+	cache := newCache(cfg, &settings)
+	if settings.IsReadOnly() {
+		cache = NewReadOnlyCache(cache)
+	}
+	storeRate, err := settings.GetStoreRate()
+	if err != nil {
+		utils.Warnf("%v, saving all results", err)
+	}
+	cache = NewSampledCache(NewSizeLimitedCache(cache, maxEntrySize), storeRate)
+	if utils.IsTracingEnabled() {
+		cache = NewTracingCache(cache)
+	}
+	return cache, newPruner(cfg, &settings)
+}
+
+// Create the configured remote cache backend, returns nil when the filesystem
+// cache should be used.
+func createRemoteCache(cfg *Configuration, settings *FsConfiguration) Cacher {
+	backend := getBackend(cfg)
+	switch backend {
+	case "gcs":
+		// attempt to load the Google Cloud cache
+		if cfg.GcsConfig != nil {
+			candidate, err := NewGcsCache(cfg.GcsConfig, settings)
+			if err == nil {
+				return candidate
+			}
+			utils.Warnf("Failed to create the GCS cache, using the filesystem cache: %v", err)
+		}
+	case "redis":
+		if cfg.RedisConfig != nil && len(cfg.RedisConfig.Address) > 0 {
+			return NewRedisCache(cfg.RedisConfig, settings)
+		}
+		utils.Warnf("Redis cache selected but no address configured, using the filesystem cache")
+	case "memcached":
+		if cfg.MemcachedConfig != nil && len(cfg.MemcachedConfig.Servers) > 0 {
+			return NewMemcachedCache(cfg.MemcachedConfig, settings)
+		}
+		utils.Warnf("Memcached cache selected but no servers configured, using the filesystem cache")
+	case "s3":
+		if cfg.S3Config != nil && len(cfg.S3Config.Bucket) > 0 {
+			candidate, err := NewS3Cache(cfg.S3Config, settings)
+			if err == nil {
+				return candidate
+			}
+			utils.Warnf("Failed to create the S3 cache, using the filesystem cache: %v", err)
+		} else {
+			utils.Warnf("S3 cache selected but no bucket configured, using the filesystem cache")
+		}
+	case "azure":
+		if cfg.AzureConfig != nil && len(cfg.AzureConfig.Container) > 0 {
+			candidate, err := NewAzureBlobCache(cfg.AzureConfig, settings)
+			if err == nil {
+				return candidate
+			}
+			utils.Warnf("Failed to create the Azure cache, using the filesystem cache: %v", err)
+		} else {
+			utils.Warnf("Azure cache selected but no container configured, using the filesystem cache")
+		}
+	case "http":
+		if cfg.HttpConfig != nil && len(cfg.HttpConfig.Url) > 0 {
+			return NewHttpCache(cfg.HttpConfig, settings)
+		}
+		utils.Warnf("HTTP cache selected but no URL configured, using the filesystem cache")
+	case "bolt":
+		return NewBoltCache(cfg.BoltConfig, settings)
+	case "sqlite":
+		candidate, err := NewSqliteCache(cfg.SqliteConfig, settings)
+		if err == nil {
+			return candidate
+		}
+		utils.Warnf("Failed to create the SQLite cache, using the filesystem cache: %v", err)
+	case "none":
+		return NewNullCache()
+	case "memory":
+		return NewInMemoryCache()
+	case "", "fs":
+	default:
+		utils.Warnf("Unknown cache backend %q, using the filesystem cache", backend)
+	}
+
+	return nil
+}
+
+func newCache(cfg *Configuration, settings *FsConfiguration) Cacher {
+	remote := createRemoteCache(cfg, settings)
+
+	// if no other cache is configured then default to the FS cache, also when
+	// the remote can not be reached, so that the results are still cached
+	if remote == nil || !isRemoteReachable(remote, settings) {
+		return newFsCacheWithFallbacks(settings)
+	}
+
+	networked := isNetworkCache(remote)
+
+	// keep the last used time of remote entries up to date
+	if !settings.IsReadOnly() {
+		remote = NewTouchingCache(remote, settings)
+	}
+
+	// repeated lookups of the same digest are answered without asking the server again
+	if networked {
+		remote = NewMemoCache(remote)
+	}
+
+	// optionally keep a local copy of the remote entries
+	if cfg.Tiered {
+		// hits of the remote are not copied either when read-only
+		return NewTieredCache(newFsCacheWithFallbacks(settings), remote)
+	}
+
+	return remote
+}
+
+// Get the name of the configured backend, a GCS configuration without a
+// backend selects the `gcs` backend for compatibility.
+func getBackend(cfg *Configuration) string {
+	if len(cfg.Backend) == 0 && cfg.GcsConfig != nil {
+		return "gcs"
+	}
+	return cfg.Backend
+}
+
+// Create the pruner for the storage of the configured backend. The other
+// remote backends can not be pruned, only the local cache of a tiered one.
+func newPruner(cfg *Configuration, settings *FsConfiguration) Pruner {
+	pruneLocal := PrunerFunc(func(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+		return pruneFs(ctx, settings, maxAge, dryRun)
+	})
+
+	backend := getBackend(cfg)
+	switch backend {
+	case "bolt":
+		boltConfig := cfg.BoltConfig
+		return PrunerFunc(func(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+			return PruneBolt(ctx, boltConfig, settings, maxAge, dryRun)
+		})
+	case "sqlite":
+		sqliteConfig := cfg.SqliteConfig
+		return PrunerFunc(func(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+			return PruneSqlite(ctx, sqliteConfig, settings, maxAge, dryRun)
+		})
+	case "s3":
+		s3Config := cfg.S3Config
+		tiered := cfg.Tiered
+		return PrunerFunc(func(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+			if err := PruneS3(ctx, s3Config, settings, maxAge, dryRun); err != nil {
+				return err
+			}
+			if tiered {
+				return pruneLocal(ctx, maxAge, dryRun)
+			}
+			return nil
+		})
+	case "gcs", "redis", "memcached", "azure", "http":
+		if cfg.Tiered {
+			return PrunerFunc(func(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+				utils.Warnf("Pruning the %s backend is not supported, only pruning the local cache", backend)
+				return pruneLocal(ctx, maxAge, dryRun)
+			})
+		}
+		return PrunerFunc(func(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+			return fmt.Errorf("Pruning the %s backend is not supported", backend)
+		})
+	}
+	return pruneLocal
+}
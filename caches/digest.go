@@ -0,0 +1,84 @@
+package caches
+
+import (
+	"os"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/clang"
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// DigestOptions are the settings of clang-tidy-cache that affect the digest of
+// an invocation, see `ComputeDigest()`. They match the fields of the same name
+// in the configuration.
+type DigestOptions struct {
+	// The clang-tidy binary, of which the content and the version output are
+	// part of the digest. Defaults to `clang-tidy` on the PATH.
+	ClangTidyPath string
+	// Replaced by a relative path in the preprocessed source, see `base_dir`
+	BaseDir string
+	// Normalize the whitespace of the preprocessed source, see `ignore_whitespace`
+	IgnoreWhitespace bool
+	// The directory that clang-tidy would run in, for the response files and
+	// the `.clang-tidy` lookup. Defaults to the current directory.
+	WorkingDir string
+	// The algorithm of the digests, `sha256` or `blake3`, see `hash`. Defaults
+	// to `utils.DEFAULT_HASH`.
+	Hash string
+}
+
+// ComputeDigest computes the digest under which clang-tidy-cache stores the
+// result of running clang-tidy with the given arguments, e.g. to check whether
+// a cache has the entry without running the wrapper. `sourceContent` is the
+// preprocessed source of the target, as produced by the compile command of the
+// compilation database with `-E -P`. When it is nil, the preprocessor is run
+// the same way the wrapper runs it. Either way the target has to be in the
+// compilation database. The digest only depends on the arguments and the
+// options, not on the configuration of the process.
+//
+// The digest of an invocation stays the same across patch releases. Runs
+// that bypass the cache, e.g. with `-fix`, still get a digest, but are never
+// stored.
+func ComputeDigest(args []string, sourceContent []byte, opts DigestOptions) ([]byte, error) {
+	clangTidyPath := opts.ClangTidyPath
+	if len(clangTidyPath) == 0 {
+		clangTidyPath = "clang-tidy"
+	}
+	hashAlgorithm, err := utils.ParseHashAlgorithm(opts.Hash)
+	if err != nil {
+		return nil, err
+	}
+	wd := opts.WorkingDir
+	if len(wd) == 0 {
+		if wd, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+
+	expandedArgs, err := clang.ExpandResponseFiles(args, wd)
+	if err != nil {
+		return nil, err
+	}
+	invocation, err := clang.ParseTidyCommand(expandedArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	if sourceContent == nil {
+		parts, err := evaluateFingerPrintParts(clangTidyPath, opts.BaseDir, opts.IgnoreWhitespace, invocation, wd, hashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		return parts.Sum(), nil
+	}
+	// the language standard and the target of the compile command are part of the digest as well
+	_, compileCommand, err := findCompileCommand(invocation)
+	if err != nil {
+		return nil, err
+	}
+	preProcessedDigest := clang.DigestPreprocessed(sourceContent, opts.BaseDir, opts.IgnoreWhitespace, hashAlgorithm)
+	parts, err := computeFingerPrintParts(clangTidyPath, invocation, wd, preProcessedDigest, compileCommand, hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	return parts.Sum(), nil
+}
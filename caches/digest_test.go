@@ -0,0 +1,73 @@
+package caches
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// A clang-tidy that only reports its version, the digest covers its content
+const fakeClangTidy = "#!/bin/sh\necho 'LLVM version 17.0.6'\n"
+
+// Set up a project with a compilation database and a configuration in a
+// temporary directory, returns the directory and the path of the clang-tidy.
+func setupDigestProject(t *testing.T) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake clang-tidy is a shell script")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"clang-tidy":            fakeClangTidy,
+		".clang-tidy":           "Checks: '-*,bugprone-*'\n",
+		"compile_commands.json": `[{"directory": "` + dir + `", "command": "clang++ -std=c++17 -o main.o -c main.cpp", "file": "` + filepath.Join(dir, "main.cpp") + `"}]`,
+		"main.cpp":              "int main() { return 0; }\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, filepath.Join(dir, "clang-tidy")
+}
+
+func TestComputeDigestGolden(t *testing.T) {
+	dir, clangTidy := setupDigestProject(t)
+	source := []byte("int main() { return 0; }\n")
+	args := []string{"-p", dir, "-checks=bugprone-*", filepath.Join(dir, "main.cpp")}
+
+	// the options select the algorithm, not the configuration of the process
+	if err := utils.SetHashAlgorithm("blake3"); err != nil {
+		t.Fatal(err)
+	}
+	defer utils.SetHashAlgorithm(utils.DEFAULT_HASH)
+
+	tests := []struct {
+		hash   string
+		digest string
+	}{
+		{"", "68ee6f02537d9ce8b854076105a624336eaa5b9ea9c0c97d2e73571405e179c1"},
+		{"sha256", "68ee6f02537d9ce8b854076105a624336eaa5b9ea9c0c97d2e73571405e179c1"},
+		{"blake3", "c1f52b5136aa61920358f1d4ac5b5ef6ef20c57f6d38b6d29533b5a6f1a47299"},
+	}
+	for _, test := range tests {
+		digest, err := ComputeDigest(args, source, DigestOptions{ClangTidyPath: clangTidy, WorkingDir: dir, Hash: test.hash})
+		if err != nil {
+			t.Fatalf("hash %q: %v", test.hash, err)
+		}
+		if got := hex.EncodeToString(digest); got != test.digest {
+			t.Errorf("hash %q: got digest %s, want %s", test.hash, got, test.digest)
+		}
+	}
+}
+
+func TestComputeDigestUnknownHash(t *testing.T) {
+	dir, clangTidy := setupDigestProject(t)
+	args := []string{"-p", dir, filepath.Join(dir, "main.cpp")}
+	if _, err := ComputeDigest(args, []byte{}, DigestOptions{ClangTidyPath: clangTidy, WorkingDir: dir, Hash: "md5"}); err == nil {
+		t.Error("expected an error for an unknown hash algorithm")
+	}
+}
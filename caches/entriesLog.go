@@ -0,0 +1,120 @@
+package caches
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Changes to the entries of ENTRIES_FILE that have not been compacted into it
+// yet, one JSON record per line
+const ENTRIES_LOG_FILE = "entries.log"
+
+// IsEntriesLog checks if changes to the consolidated entries are appended to
+// ENTRIES_LOG_FILE rather than rewriting ENTRIES_FILE, which is enabled by
+// setting `entries_log` in the configuration, or CLANG_TIDY_CACHE_ENTRIES_LOG
+// to 1. This is for large shared caches where
+// `SaveEntries()`, pins and the removal of expired entries would otherwise
+// rewrite the whole JSON each time. The log is compacted into ENTRIES_FILE by
+// `Prune()`, and by anything else that rewrites it.
+func (cfg *FsConfiguration) IsEntriesLog() bool {
+	return cfg.EntriesLog
+}
+
+// A line of ENTRIES_LOG_FILE: the entry of a digest with its content inline,
+// or the removal of the digest when there is no entry.
+type entriesLogRecord struct {
+	Key   string `json:"key"`
+	Entry *Entry `json:"entry,omitempty"`
+}
+
+// Append the entries and the removal of the digests to ENTRIES_LOG_FILE with
+// a single write. The caller holds the exclusive lock of the entries.
+func appendEntriesLog(root string, entries Entries, removed []string, fileMode os.FileMode) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for key, entry := range entries {
+		entry := entry
+		if err := encoder.Encode(entriesLogRecord{Key: key, Entry: &entry}); err != nil {
+			return err
+		}
+	}
+	for _, key := range removed {
+		if err := encoder.Encode(entriesLogRecord{Key: key}); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(root, ENTRIES_LOG_FILE), os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Apply the records of ENTRIES_LOG_FILE to the entries read from ENTRIES_FILE,
+// the last record of a digest wins. Lines that can not be decoded, e.g. the
+// last line of a write that was interrupted, are skipped and returned.
+func applyEntriesLog(root string, entries Entries) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, ENTRIES_LOG_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	skipped := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record entriesLogRecord
+		if err := json.Unmarshal(line, &record); err != nil || len(record.Key) == 0 {
+			skipped = append(skipped, string(line))
+			continue
+		}
+		if record.Entry == nil {
+			delete(entries, record.Key)
+		} else {
+			entries[record.Key] = *record.Entry
+		}
+	}
+	return skipped, scanner.Err()
+}
+
+// Write the entries to ENTRIES_FILE and drop ENTRIES_LOG_FILE, of which the
+// records have to be part of the entries.
+func compactJson(root string, entries Entries, fileMode os.FileMode) error {
+	if err := writeJson(root, entries, fileMode); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(root, ENTRIES_LOG_FILE)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Save changes to the entries of the JSON, which are the entries after the
+// change: appended to ENTRIES_LOG_FILE with `log`, otherwise by writing all of
+// them. `changed` and `removed` are the digests that changed.
+func updateJson(root string, entries Entries, changed []string, removed []string, fileMode os.FileMode, log bool) error {
+	if !log {
+		return compactJson(root, entries, fileMode)
+	}
+	records := Entries{}
+	for _, key := range changed {
+		records[key] = entries[key]
+	}
+	return appendEntriesLog(root, records, removed, fileMode)
+}
@@ -0,0 +1,42 @@
+package caches
+
+import (
+	"context"
+	"errors"
+)
+
+// The errors of the caches are wrapped along with their cause, use
+// `errors.Is()` to check for them.
+var (
+	// ErrNotFound is returned by `Lookup()` for a cache miss. `FindEntry()`
+	// reports a miss with its boolean instead, since entries can be empty.
+	ErrNotFound = errors.New("Cache entry not found")
+	// ErrCorrupt is returned for an entry that can not be read, e.g. because
+	// its checksum does not match. Saving the entry again replaces it.
+	ErrCorrupt = errors.New("Corrupt cache entry")
+	// ErrBackendUnavailable is returned when the backend can not be used,
+	// e.g. a remote server that can not be reached even after the retries of
+	// `GetRemoteRetries()`, or a database that is locked by another process.
+	ErrBackendUnavailable = errors.New("Cache backend unavailable")
+)
+
+// IsSoftError checks if the error of a cache operation only means that the
+// entry can not be used, so that clang-tidy can simply run instead: the entry
+// is corrupt or the backend is unavailable. Other errors, e.g. of the local
+// filesystem, are unexpected.
+func IsSoftError(err error) bool {
+	return errors.Is(err, ErrCorrupt) || errors.Is(err, ErrBackendUnavailable)
+}
+
+// Lookup finds the content of the entry like `FindEntry()`, but reports a
+// miss as `ErrNotFound`.
+func Lookup(ctx context.Context, cache Cacher, digest []byte) ([]byte, error) {
+	content, found, err := cache.FindEntry(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return content, nil
+}
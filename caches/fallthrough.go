@@ -0,0 +1,75 @@
+package caches
+
+import (
+	"context"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// FallthroughCache looks up the entries in a list of caches in turn, e.g. a
+// personal cache on a local disk in front of a team cache on a network share.
+// Entries are only saved in the first cache, the others are never written to.
+type FallthroughCache struct {
+	caches []Cacher
+}
+
+func NewFallthroughCache(first Cacher, others ...Cacher) *FallthroughCache {
+	return &FallthroughCache{
+		caches: append([]Cacher{first}, others...),
+	}
+}
+
+// Create the filesystem cache, looking up the entries it misses in the other
+// directories of `cache_dir`, if any. These are only read: hits there are
+// copied into the first directory, and they do not get their last used time
+// updated or expired entries removed.
+func newFsCacheWithFallbacks(settings *FsConfiguration) Cacher {
+	var cache Cacher = NewFsCache(settings)
+	if settings.IsReadOnly() {
+		cache = NewReadOnlyCache(cache)
+	}
+	fallbacks := []Cacher{}
+	for _, root := range settings.getFallbackCachePaths() {
+		fallback := NewFsCache(settings)
+		fallback.root = root
+		fallback.legacyRoot = ""
+		fallback.readOnly = true
+		fallbacks = append(fallbacks, fallback)
+	}
+	if len(fallbacks) == 0 {
+		return cache
+	}
+	return NewFallthroughCache(cache, fallbacks...)
+}
+
+// Hits in the later caches are copied into the first cache for the next lookup.
+// An error of one cache is logged and the lookup goes on with the next one, so
+// a network share that can not be read is a miss rather than failing the run.
+func (c *FallthroughCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	for i, cache := range c.caches {
+		content, found, err := cache.FindEntry(ctx, digest)
+		if err != nil {
+			utils.Warnf("Error reading from cache %d of %d: %v", i+1, len(c.caches), err)
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		if i > 0 {
+			if err := c.caches[0].SaveEntry(ctx, digest, content); err != nil {
+				utils.Warnf("Error copying the cache entry: %v", err)
+			}
+		}
+		return content, true, nil
+	}
+	return nil, false, nil
+}
+
+func (c *FallthroughCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	return c.caches[0].SaveEntry(ctx, digest, content)
+}
+
+func (c *FallthroughCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	return SaveEntries(ctx, c.caches[0], entries)
+}
@@ -1,220 +1,1589 @@
 package caches
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/user"
-	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
 )
 
 type FileSystemCache struct {
 	root string
+	// Cache of earlier versions that is still used for lookups, if any
+	legacyRoot string
+	depth      int
+	dirMode    os.FileMode
+	fileMode   os.FileMode
+	// Time to live of the entries that are saved, zero means unlimited
+	ttl time.Duration
+	// Only look up entries, see `IsReadOnly()`
+	readOnly bool
+	// Codec of the entries that are saved, see `GetCompression()`
+	compression string
+	// Append changes of the JSON to ENTRIES_LOG_FILE, see `IsEntriesLog()`
+	entriesLog bool
 }
 
 type Entry struct {
-	Content  string    `json:"content,omitempty"`
-	LastUsed time.Time `json:"last_used"`
+	Content    string    `json:"content,omitempty"`
+	Compressed []byte    `json:"compressed,omitempty"`
+	LastUsed   time.Time `json:"last_used"`
+	// SHA256 of the uncompressed content, missing for entries of older versions
+	Checksum string `json:"checksum,omitempty"`
+	// SHA256 of the content in BODIES_FILE, which is shared by all of the
+	// entries with the same content. It is only set in ENTRIES_FILE, once the
+	// entries are read their content is inline again.
+	Body string `json:"body,omitempty"`
+	// Time after which the entry is a miss, regardless of when it was used
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Kept by `Prune()` regardless of when it was used, see `Pin()`
+	Pinned bool `json:"pinned,omitempty"`
 }
 
 type Entries map[string]Entry
 
+// Body is the (compressed) content of one or more entries.
+type Body struct {
+	Content    string `json:"content,omitempty"`
+	Compressed []byte `json:"compressed,omitempty"`
+}
+
+type Bodies map[string]Body
+
 const ENTRIES_FILE = "entries.json"
 
+// Content of the entries in ENTRIES_FILE by SHA256, each distinct content is
+// stored once
+const BODIES_FILE = "bodies.json"
+
+// JSON files that can not be decoded are renamed to e.g. `entries.json.corrupt.<time>`
+const CORRUPT_JSON_INFIX = ".corrupt."
+
+// Number of directory levels the entries are spread over, of two hex characters each
+const DEFAULT_SHARD_DEPTH = 2
+const MAX_SHARD_DEPTH = 8
+
+const WEEK = 7 * 24 * time.Hour
+
+// Temporary files older than this are leftovers of interrupted writes
+const STALE_TEMP_FILE_AGE = time.Hour
+
+// Advisory lock guarding ENTRIES_FILE against concurrent readers and writers
+const LOCK_FILE = "entries.lock"
+
+// Advisory lock held for the whole of a prune, so that a second prune fails
+// right away instead of consolidating the cache again once the first is done
+const PRUNE_LOCK_FILE = "prune.lock"
+
+type PruneConfiguration struct {
+	// Default number of weeks for `prune`
+	Weeks int `json:"weeks"`
+	// Default maximum age for `prune` instead of the weeks, e.g. `36h`
+	MaxAge     string `json:"max_age"`
+	MaxSize    string `json:"max_size"`
+	MaxEntries int    `json:"max_entries"`
+	// Prune refuses to write the JSON when it finds fewer entries
+	MinEntries *int `json:"min_entries,omitempty"`
+}
+
+// FsConfiguration holds the settings of the filesystem cache, which also apply
+// to the other caches where they make sense. The command line tool fills them
+// in from its configuration files and environment variables. The caches only
+// read the settings they are created with, so that caches with different
+// settings can be used side by side.
+type FsConfiguration struct {
+	CacheDir    string             `json:"cache_dir"`
+	Compression string             `json:"compression"`
+	ShardDepth  *int               `json:"shard_depth,omitempty"`
+	DirMode     string             `json:"dir_mode"`
+	FileMode    string             `json:"file_mode"`
+	Prune       PruneConfiguration `json:"prune"`
+	// Interval at which hits are passed on to remote caches that track them
+	TouchInterval string `json:"touch_interval"`
+	// Keeps the entries apart from those of other namespaces, also in remote caches
+	Namespace string `json:"namespace"`
+	// Results larger than this are not cached, in any cache
+	MaxEntrySize string `json:"max_entry_size"`
+	// Number of times failed operations on remote caches are retried
+	RemoteRetries *int `json:"remote_retries,omitempty"`
+	// Only look up entries, see `IsReadOnly()`
+	ReadOnly bool `json:"read_only"`
+	// Append changes of the JSON to a log, see `IsEntriesLog()`
+	EntriesLog bool `json:"entries_log"`
+	// Fraction of the results that are saved, see `GetStoreRate()`
+	StoreRate *float64 `json:"store_rate,omitempty"`
+	// Time to live of the entries that are saved, see `GetEntryTTL()`
+	EntryTTL string `json:"-"`
+	// Record the cache events, see `IsAuditEnabled()`
+	Audit bool `json:"-"`
+}
+
+var fsConfig = FsConfiguration{}
+
+// SetFsConfiguration sets the settings used by the functions of the package
+// that work on the filesystem cache of the process rather than on a cache,
+// such as `Clear()`, `Pin()`, `PrintStats()` and `RecordEvent()`. The caches
+// created by `New()` use the settings of their configuration instead.
+func SetFsConfiguration(cfg FsConfiguration) {
+	fsConfig = cfg
+}
+
+var homeDirWarning sync.Once
+
 // GetFileSystemCachePath gets the path to the directory to use for storing the
-// cache. It defaults to ~/.ctcache/cache and can be overridden by setting
-// CLANG_TIDY_CACHE_DIR environment variable.
-func GetFileSystemCachePath() string {
-	if envPath := os.Getenv("CLANG_TIDY_CACHE_DIR"); len(envPath) > 0 {
-		return envPath
+// cache. It defaults to $XDG_CACHE_HOME/ctcache, or ~/.cache/ctcache when
+// XDG_CACHE_HOME is not set, and can be overridden by setting `cache_dir` in
+// the configuration or the CLANG_TIDY_CACHE_DIR environment variable. Without
+// a home directory, the cache is stored in the temporary directory. When a
+// list of directories is set, this is the first one, see
+// `getFallbackCachePaths()`.
+func (cfg *FsConfiguration) GetFileSystemCachePath() string {
+	return cfg.namespacePath(cfg.getBaseFileSystemCachePath())
+}
+
+// Get the directory of the current namespace in the cache directory.
+func (cfg *FsConfiguration) namespacePath(cacheDir string) string {
+	if namespace := cfg.GetNamespace(); len(namespace) > 0 {
+		return filepath.Join(cacheDir, NAMESPACES_DIR, namespace)
+	}
+	return cacheDir
+}
+
+// Get the cache directories set by `cache_dir`, which can be a list separated
+// like PATH, e.g. `/ssd/ctcache:/mnt/team/ctcache`.
+func (cfg *FsConfiguration) getCacheDirs() []string {
+	dirs := []string{}
+	for _, dir := range filepath.SplitList(cfg.CacheDir) {
+		if len(dir) > 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Get the cache directories after the first one, in the current namespace.
+// Lookups that miss the first directory try each of them in turn, but they
+// are never written to.
+func (cfg *FsConfiguration) getFallbackCachePaths() []string {
+	paths := []string{}
+	dirs := cfg.getCacheDirs()
+	for i := 1; i < len(dirs); i++ {
+		paths = append(paths, cfg.namespacePath(dirs[i]))
+	}
+	return paths
+}
+
+func (cfg *FsConfiguration) getBaseFileSystemCachePath() string {
+	if dirs := cfg.getCacheDirs(); len(dirs) > 0 {
+		return dirs[0]
+	}
+	if xdgCacheHome := os.Getenv("XDG_CACHE_HOME"); len(xdgCacheHome) > 0 {
+		return filepath.Join(xdgCacheHome, "ctcache")
+	}
+
+	home, err := utils.HomeDir()
+	if err != nil {
+		cacheDir := filepath.Join(os.TempDir(), "ctcache", "cache")
+		homeDirWarning.Do(func() {
+			utils.Warnf("%v, using %s for the cache, set CLANG_TIDY_CACHE_DIR to change it", err, cacheDir)
+		})
+		return cacheDir
+	}
+	return filepath.Join(home, ".cache", "ctcache")
+}
+
+// Get the location of the cache used by earlier versions, ~/.ctcache/cache,
+// if it exists and the location of the cache is not configured.
+func (cfg *FsConfiguration) getLegacyFileSystemCachePath() string {
+	if len(cfg.CacheDir) > 0 || len(cfg.GetNamespace()) > 0 {
+		return ""
+	}
+	home, err := utils.HomeDir()
+	if err != nil {
+		return ""
+	}
+
+	legacyDir := filepath.Join(home, ".ctcache", "cache")
+	if info, err := os.Stat(legacyDir); err != nil || !info.IsDir() || legacyDir == cfg.GetFileSystemCachePath() {
+		return ""
+	}
+	return legacyDir
+}
+
+// GetMaxCacheSize gets the size budget of the cache in bytes from
+// `prune.max_size` in the configuration, or CLANG_TIDY_CACHE_MAX_SIZE, e.g.
+// `5GB`. Zero means that the size of the cache is not limited.
+func (cfg *FsConfiguration) GetMaxCacheSize() (int64, error) {
+	if size := cfg.Prune.MaxSize; len(size) > 0 {
+		return utils.ParseSize(size)
+	}
+	return 0, nil
+}
+
+// GetMaxAge gets the maximum age of the entries kept by a prune from
+// `prune.max_age` in the configuration, or CLANG_TIDY_CACHE_TTL, in the format
+// of `time.ParseDuration()`, e.g. `36h`. Zero means that it is not set.
+func (cfg *FsConfiguration) GetMaxAge() (time.Duration, error) {
+	maxAge := cfg.Prune.MaxAge
+	if len(maxAge) == 0 {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(maxAge)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("Invalid maximum age %q", maxAge)
+	}
+	return duration, nil
+}
+
+// GetMaxCacheEntries gets the maximum number of entries in the cache from
+// `prune.max_entries` in the configuration, or CLANG_TIDY_CACHE_MAX_ENTRIES.
+// Zero means that the number of entries is not limited.
+func (cfg *FsConfiguration) GetMaxCacheEntries() (int, error) {
+	if cfg.Prune.MaxEntries < 0 {
+		return 0, fmt.Errorf("Invalid number of entries %d", cfg.Prune.MaxEntries)
+	}
+	return cfg.Prune.MaxEntries, nil
+}
+
+// A prune that finds no entries at all most likely looks at the wrong directory
+const DEFAULT_PRUNE_MIN_ENTRIES = 1
+
+// GetMinCacheEntries gets the number of entries that a prune needs to find to
+// go ahead from `prune.min_entries` in the configuration, or
+// CLANG_TIDY_CACHE_PRUNE_MIN_ENTRIES. It defaults to 1, zero disables the
+// check.
+func (cfg *FsConfiguration) GetMinCacheEntries() (int, error) {
+	if cfg.Prune.MinEntries == nil {
+		return DEFAULT_PRUNE_MIN_ENTRIES, nil
+	}
+	if *cfg.Prune.MinEntries < 0 {
+		return 0, fmt.Errorf("Invalid number of entries %d", *cfg.Prune.MinEntries)
+	}
+	return *cfg.Prune.MinEntries, nil
+}
+
+// GetShardDepth gets the number of directory levels the entries are spread
+// over. It defaults to 2, e.g. `ab/cd/efg...`, and can be overridden by setting
+// `shard_depth` in the configuration, or CLANG_TIDY_CACHE_SHARD_DEPTH, to a
+// value from 0 (no directories) to 8.
+func (cfg *FsConfiguration) GetShardDepth() int {
+	if cfg.ShardDepth == nil {
+		return DEFAULT_SHARD_DEPTH
+	}
+	if depth := *cfg.ShardDepth; depth < 0 || depth > MAX_SHARD_DEPTH {
+		utils.Warnf("Invalid shard depth %d, using the default of %d", depth, DEFAULT_SHARD_DEPTH)
+		return DEFAULT_SHARD_DEPTH
 	}
-	usr, _ := user.Current()
-	return path.Join(usr.HomeDir, ".ctcache", "cache")
+	return *cfg.ShardDepth
 }
 
-func NewFsCache() *FileSystemCache {
+// GetEntryTTL gets the time to live of the entries that are saved, which the
+// command line tool takes from the CLANG_TIDY_CACHE_ENTRY_TTL environment
+// variable, in the format of `time.ParseDuration()`. Zero means that the
+// entries do not expire and are only removed by pruning.
+func (cfg *FsConfiguration) GetEntryTTL() time.Duration {
+	if len(cfg.EntryTTL) == 0 {
+		return 0
+	}
+
+	ttl, err := time.ParseDuration(cfg.EntryTTL)
+	if err != nil || ttl < 0 {
+		utils.Warnf("Invalid entry TTL %q, the entries do not expire", cfg.EntryTTL)
+		return 0
+	}
+	return ttl
+}
+
+// NewFsCache creates the filesystem cache with the settings.
+func NewFsCache(settings *FsConfiguration) *FileSystemCache {
 	return &FileSystemCache{
-		root: GetFileSystemCachePath(),
+		root:        settings.GetFileSystemCachePath(),
+		legacyRoot:  settings.getLegacyFileSystemCachePath(),
+		depth:       settings.GetShardDepth(),
+		dirMode:     settings.GetDirMode(),
+		fileMode:    settings.GetFileMode(),
+		ttl:         settings.GetEntryTTL(),
+		readOnly:    settings.IsReadOnly(),
+		compression: settings.GetCompression(),
+		entriesLog:  settings.IsEntriesLog(),
+	}
+}
+
+// Create an entry, compressing the content with the codec.
+func newEntry(content []byte, lastUsed time.Time, codec string) (Entry, error) {
+	checksum := sha256.Sum256(content)
+	if codec == COMPRESSION_NONE {
+		return Entry{Content: string(content), LastUsed: lastUsed, Checksum: hex.EncodeToString(checksum[:])}, nil
+	}
+
+	compressed, err := compress(content, codec)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Compressed: compressed, LastUsed: lastUsed, Checksum: hex.EncodeToString(checksum[:])}, nil
+}
+
+// Get the entry of ENTRIES_FILE with its content from BODIES_FILE inline again.
+func (e Entry) withBody(body Body) Entry {
+	return Entry{
+		Content:    body.Content,
+		Compressed: body.Compressed,
+		LastUsed:   e.LastUsed,
+		Checksum:   e.Body,
+		ExpiresAt:  e.ExpiresAt,
+		Pinned:     e.Pinned,
+	}
+}
+
+// Check if the entry has expired at the given time.
+func (e Entry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// Get the uncompressed content of the entry, verifying its checksum if it has one.
+func (e Entry) content() ([]byte, error) {
+	content := []byte(e.Content)
+	if e.Compressed != nil {
+		var err error
+		if content, err = decompress(e.Compressed); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+
+	if len(e.Checksum) > 0 {
+		checksum := sha256.Sum256(content)
+		if hex.EncodeToString(checksum[:]) != e.Checksum {
+			return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+		}
+	}
+	return content, nil
+}
+
+// Entry files start with this magic number followed by the SHA256 of the
+// uncompressed content. Files of older versions only contain the content.
+var entryFileMagic = []byte("ctc1")
+
+// Entry files that expire start with this magic number instead, and have the
+// expiry time in seconds since the epoch after the SHA256. They are only
+// written for entries with a TTL, as older versions can not read them.
+var entryFileMagicExpiry = []byte("ctc2")
+
+// Size of the header of an entry file that starts with the magic number.
+func entryFileHeaderSize(magic []byte) int {
+	if bytes.Equal(magic, entryFileMagicExpiry) {
+		return len(entryFileMagicExpiry) + sha256.Size + 8
+	}
+	if bytes.Equal(magic, entryFileMagic) {
+		return len(entryFileMagic) + sha256.Size
+	}
+	return 0
+}
+
+// Get the checksum of the content and the expiry time from a header.
+func parseEntryFileHeader(header []byte) ([]byte, *time.Time) {
+	checksum := header[len(entryFileMagic) : len(entryFileMagic)+sha256.Size]
+	if !bytes.HasPrefix(header, entryFileMagicExpiry) {
+		return checksum, nil
+	}
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(header[len(entryFileMagic)+sha256.Size:])), 0)
+	return checksum, &expiresAt
+}
+
+// Write the content to an entry file, compressing it with the codec. The
+// checksum in the header is filled in once all of the content has been
+// written.
+func writeEntryFile(entryPath string, content io.Reader, expiresAt *time.Time, perm os.FileMode, codec string) error {
+	return utils.WriteFileAtomicFunc(entryPath, perm, func(file *os.File) error {
+		magic := entryFileMagic
+		if expiresAt != nil {
+			magic = entryFileMagicExpiry
+		}
+		header := make([]byte, entryFileHeaderSize(magic))
+		copy(header, magic)
+		if expiresAt != nil {
+			binary.BigEndian.PutUint64(header[len(magic)+sha256.Size:], uint64(expiresAt.Unix()))
+		}
+		if _, err := file.Write(header); err != nil {
+			return err
+		}
+
+		hasher := sha256.New()
+		writer, err := newCompressWriter(file, codec)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, io.TeeReader(content, hasher)); err != nil {
+			writer.Close()
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+
+		_, err = file.WriteAt(hasher.Sum(nil), int64(len(entryFileMagic)))
+		return err
+	})
+}
+
+// Reader of the content of an entry file, which verifies the checksum of the
+// content once it has been read completely.
+type entryReader struct {
+	file      *os.File
+	content   io.ReadCloser
+	hasher    hash.Hash
+	checksum  []byte
+	expiresAt *time.Time
+}
+
+// Open the content of an entry file. Files of older versions have no header
+// and therefore no checksum.
+func newEntryReader(file *os.File) (*entryReader, error) {
+	buffered := bufio.NewReader(file)
+	var checksum []byte
+	var expiresAt *time.Time
+	magic, _ := buffered.Peek(len(entryFileMagic))
+	if headerSize := entryFileHeaderSize(magic); headerSize > 0 {
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(buffered, header); err != nil {
+			return nil, fmt.Errorf("%w: truncated file", ErrCorrupt)
+		}
+		checksum, expiresAt = parseEntryFileHeader(header)
+	}
+
+	content, err := newDecompressReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return &entryReader{file: file, content: content, hasher: sha256.New(), checksum: checksum, expiresAt: expiresAt}, nil
+}
+
+func (r *entryReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF {
+		if r.checksum != nil && !bytes.Equal(r.hasher.Sum(nil), r.checksum) {
+			return n, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+		}
+	} else if err != nil {
+		return n, fmt.Errorf("%w: %v", ErrCorrupt, err)
 	}
+	return n, err
 }
 
-// Read the cache entries from JSON. For errors, we log and return an empty
-// `Entries` map so that execution can continue.
-func readJson(filepath string) Entries {
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
-		return Entries{} // file doesn't exist yet, equivalent to empty file
+func (r *entryReader) Close() error {
+	r.content.Close()
+	return r.file.Close()
+}
+
+// Decode the content of an entry file along with its expiry time, verifying
+// its checksum if it has one.
+func decodeEntryFile(data []byte) ([]byte, *time.Time, error) {
+	var checksum []byte
+	var expiresAt *time.Time
+	if len(data) >= len(entryFileMagic) {
+		if headerSize := entryFileHeaderSize(data[:len(entryFileMagic)]); headerSize > 0 {
+			if len(data) < headerSize {
+				return nil, nil, fmt.Errorf("%w: truncated file", ErrCorrupt)
+			}
+			checksum, expiresAt = parseEntryFileHeader(data[:headerSize])
+			data = data[headerSize:]
+		}
+	}
+
+	content, err := decompress(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
+	if checksum != nil {
+		actual := sha256.Sum256(content)
+		if !bytes.Equal(actual[:], checksum) {
+			return nil, nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+		}
+	}
+	return content, expiresAt, nil
+}
+
+// Version of the layout of ENTRIES_FILE. Version 1 is a flat map of the
+// entries by digest, later versions wrap the map in an `entriesFile`.
+const ENTRIES_VERSION = 2
+
+var errUnsupportedVersion = errors.New("Unsupported version of the cache JSON")
+
+type entriesFile struct {
+	Version int     `json:"version"`
+	Entries Entries `json:"entries"`
+}
+
+// Decode both the current layout and the flat map of version 1, which is
+// migrated to the current version.
+func (f *entriesFile) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	// the keys of version 1 are digests, so it can never have a version
+	if _, exists := fields["version"]; !exists {
+		f.Version = ENTRIES_VERSION
+		f.Entries = Entries{}
+		return json.Unmarshal(data, &f.Entries)
+	}
+
+	// avoid recursing into this method
+	type plainEntriesFile entriesFile
+	if err := json.Unmarshal(data, (*plainEntriesFile)(f)); err != nil {
+		return err
+	}
+	if f.Version > ENTRIES_VERSION {
+		return fmt.Errorf("%w: %d", errUnsupportedVersion, f.Version)
+	}
+	if f.Entries == nil {
+		f.Entries = Entries{}
+	}
+	return nil
+}
+
+// The JSON could be read but not decoded
+var errCorruptJson = errors.New("Corrupt cache JSON")
+
+// Decode the JSON file into value, a missing file leaves value as is.
+func readJsonFile(jsonPath string, value interface{}) error {
+	if _, err := os.Stat(jsonPath); os.IsNotExist(err) {
+		return nil // file doesn't exist yet, equivalent to empty file
+	}
+
+	jsonData, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(jsonData, value)
+	if err != nil && !errors.Is(err, errUnsupportedVersion) {
+		return fmt.Errorf("%w %s: %v", errCorruptJson, jsonPath, err)
+	}
+	return err
+}
+
+// Move a JSON file that can not be decoded aside, so that it can be inspected
+// and is not overwritten by the next write of the entries.
+func quarantineJson(jsonPath string) {
+	corruptPath := jsonPath + CORRUPT_JSON_INFIX + time.Now().UTC().Format("20060102T150405Z")
+	if err := os.Rename(jsonPath, corruptPath); err != nil {
+		// another process may have moved it already
+		if !os.IsNotExist(err) {
+			utils.Warnf("Error moving corrupt cache JSON aside: %v", err)
+		}
+		return
+	}
+	utils.Warnf("Moved corrupt cache JSON to %s", corruptPath)
+}
+
+// Check if the file is a JSON file that was moved aside by `quarantineJson()`.
+func isCorruptJson(name string) bool {
+	return strings.HasPrefix(name, ENTRIES_FILE+CORRUPT_JSON_INFIX) || strings.HasPrefix(name, BODIES_FILE+CORRUPT_JSON_INFIX)
+}
+
+// Read the cache entries from JSON, along with their shared content from
+// BODIES_FILE next to it and the changes in ENTRIES_LOG_FILE that have not
+// been compacted yet. Entries of older versions have their content inline.
+// For most errors, we log and return an empty `Entries` map so that execution
+// can continue, a file that can not be decoded is moved aside first. A file
+// written by a newer version is an error instead, so that it is not overwritten.
+func readJson(jsonPath string) (Entries, error) {
+	return readJsonEntries(jsonPath, true)
+}
+
+// Read the cache entries from JSON in order to rewrite it. Unlike `readJson()`
+// every error is returned and nothing is moved aside, so that a file that
+// could not be read is never replaced by the entries that happen to be on disk.
+func readJsonForRewrite(jsonPath string) (Entries, error) {
+	return readJsonEntries(jsonPath, false)
+}
+
+func readJsonEntries(jsonPath string, lenient bool) (Entries, error) {
+	file := entriesFile{Entries: Entries{}}
+	if err := readJsonFile(jsonPath, &file); err != nil {
+		if !lenient || errors.Is(err, errUnsupportedVersion) {
+			return nil, err
+		}
+		utils.Warnf("Error reading cache JSON: %v", err)
+		if errors.Is(err, errCorruptJson) {
+			quarantineJson(jsonPath)
+			file.Entries = Entries{}
+		}
+	}
+	entries := file.Entries
+
+	bodies := Bodies{}
+	for key, entry := range entries {
+		if len(entry.Body) == 0 {
+			continue
+		}
+		if len(bodies) == 0 {
+			bodiesPath := filepath.Join(filepath.Dir(jsonPath), BODIES_FILE)
+			if err := readJsonFile(bodiesPath, &bodies); err != nil {
+				if !lenient {
+					return nil, err
+				}
+				utils.Warnf("Error reading cache JSON: %v", err)
+				if errors.Is(err, errCorruptJson) {
+					quarantineJson(bodiesPath)
+					bodies = Bodies{}
+				}
+			}
+		}
+
+		// a missing body leaves the entry empty, which fails its checksum
+		entries[key] = entry.withBody(bodies[entry.Body])
+	}
+
+	skipped, err := applyEntriesLog(filepath.Dir(jsonPath), entries)
+	if err != nil {
+		if !lenient {
+			return nil, err
+		}
+		utils.Warnf("Error reading %s: %v", ENTRIES_LOG_FILE, err)
+	}
+	if len(skipped) > 0 {
+		utils.Warnf("Skipped %d records of %s that could not be decoded", len(skipped), ENTRIES_LOG_FILE)
+	}
+	return entries, nil
+}
+
+// Write the cache entries to JSON, storing each distinct content only once in
+// BODIES_FILE. Entries without a checksum keep their content inline. The bodies
+// are written first so that the entries never refer to a missing body. Both
+// files list their entries sorted by digest, since `encoding/json` sorts the
+// keys of maps, so the same entries always give the same files.
+func writeJson(root string, entries Entries, fileMode os.FileMode) error {
+	bodies := Bodies{}
+	stored := Entries{}
+	for key, entry := range entries {
+		if len(entry.Checksum) == 0 {
+			stored[key] = entry
+			continue
+		}
+		if _, exists := bodies[entry.Checksum]; !exists {
+			bodies[entry.Checksum] = Body{Content: entry.Content, Compressed: entry.Compressed}
+		}
+		stored[key] = Entry{LastUsed: entry.LastUsed, Body: entry.Checksum, ExpiresAt: entry.ExpiresAt, Pinned: entry.Pinned}
 	}
 
-	jsonData, err := ioutil.ReadFile(filepath)
+	bodiesData, err := json.MarshalIndent(bodies, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = utils.WriteFileAtomic(filepath.Join(root, BODIES_FILE), bodiesData, fileMode)
 	if err != nil {
-		fmt.Printf("Error reading cache JSON: %v\n", err)
-		return Entries{}
+		return err
 	}
 
-	entries := Entries{}
-	err = json.Unmarshal(jsonData, &entries)
+	jsonData, err := json.MarshalIndent(entriesFile{Version: ENTRIES_VERSION, Entries: stored}, "", "  ")
 	if err != nil {
-		fmt.Printf("Error decoding cache JSON: %v\n", err)
+		return err
 	}
-	return entries
+	return utils.WriteFileAtomic(filepath.Join(root, ENTRIES_FILE), jsonData, fileMode)
 }
 
-// Check if we have a cache hit in JSON
-func checkJsonEntry(c *FileSystemCache, digest []byte) []byte {
-	entries := readJson(path.Join(c.root, ENTRIES_FILE))
+// Check if the file is one of the files with metadata in the root of the cache
+// rather than an entry. Files with the same name in the shard directories are
+// not special.
+func isCacheMetadata(root string, path string) bool {
+	if filepath.Dir(path) != filepath.Clean(root) {
+		return false
+	}
+	name := filepath.Base(path)
+	return name == ENTRIES_FILE || name == BODIES_FILE || name == ENTRIES_LOG_FILE || name == LOCK_FILE || name == PRUNE_LOCK_FILE || name == STATS_FILE || name == STATS_LOCK_FILE ||
+		name == AUDIT_FILE || name == BOLT_FILE || name == REMOTE_DOWN_FILE || isSqliteFile(name) || isTouchFile(name) || isCorruptJson(name)
+}
+
+// Lock the entries of the cache: shared for readers, exclusive for writers.
+func lockEntries(root string, exclusive bool, fileMode os.FileMode) (*utils.FileLock, error) {
+	return utils.LockFile(filepath.Join(root, LOCK_FILE), fileMode, exclusive)
+}
+
+// Check if we have a cache hit in JSON. Errors reading the JSON are logged,
+// only a corrupt entry is returned as an error.
+func checkJsonEntry(ctx context.Context, c *FileSystemCache, root string, digest []byte) ([]byte, bool, error) {
+	entriesPath := filepath.Join(root, ENTRIES_FILE)
+	if _, err := os.Stat(entriesPath); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(root, ENTRIES_LOG_FILE)); os.IsNotExist(err) {
+			return nil, false, nil
+		}
+	}
+
+	lock, err := lockEntries(root, false, c.fileMode)
+	if err != nil {
+		utils.Warnf("Error locking cache JSON: %v", err)
+		return nil, false, nil
+	}
+	entries, err := readJson(entriesPath)
+	lock.Unlock()
+	if err != nil {
+		utils.Warnf("%v", err)
+		return nil, false, nil
+	}
+
 	entry, exists := entries[hex.EncodeToString(digest)]
 	if !exists {
-		return nil
+		return nil, false, nil
+	}
+	if entry.expired(time.Now()) {
+		if !c.readOnly {
+			c.removeJsonEntry(root, hex.EncodeToString(digest))
+		}
+		return nil, false, nil
+	}
+
+	result, err := entry.content()
+	if err != nil {
+		return nil, false, err
 	}
+	c.markUsed(digest, result, entry.ExpiresAt)
+	return result, true, nil
+}
 
-	result := []byte(entry.Content)
-	c.SaveEntry(digest, result) // to update the last used time
-	return result
+// Update the last used time of an entry in the JSON. The entry file written
+// by an earlier hit is touched rather than written again, only the first hit
+// since `Prune()` or a file of another user that can not be touched writes it.
+func (c *FileSystemCache) markUsed(digest []byte, content []byte, expiresAt *time.Time) {
+	if c.readOnly {
+		return
+	}
+	_, entryPath, err := defineShardedPath(c.root, digest, c.depth)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(entryPath, now, now); err == nil {
+		return
+	}
+	if err := c.saveEntry(digest, bytes.NewReader(content), expiresAt); err != nil {
+		utils.Debugf("Error updating cache entry: %v", err)
+	}
 }
 
-// Check if we have a cache hit in the filesystem
-func checkFsEntry(c *FileSystemCache, digest []byte) ([]byte, error) {
-	_, entryPath := defineEntryPath(c.root, digest)
-	_, err := os.Stat(entryPath)
+// Remove an expired entry from the JSON. This is best-effort, since `Prune()`
+// removes expired entries as well. Pinned entries are kept, since the next
+// result saved for the digest inherits the pin.
+func (c *FileSystemCache) removeJsonEntry(root string, key string) {
+	lock, err := lockEntries(root, true, c.fileMode)
+	if err != nil {
+		utils.Warnf("Error locking cache JSON: %v", err)
+		return
+	}
+	defer lock.Unlock()
 
+	entries, err := readJsonForRewrite(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		utils.Warnf("%v", err)
+		return
+	}
+	if entry, exists := entries[key]; !exists || entry.Pinned {
+		return
+	}
+	delete(entries, key)
+	if err := updateJson(root, entries, nil, []string{key}, c.fileMode, c.entriesLog); err != nil {
+		utils.Warnf("Error removing expired cache entry: %v", err)
+	}
+}
+
+// Check if we have a cache hit in the filesystem, with the configured layout
+// or the default layout used by earlier versions
+func checkFsEntry(c *FileSystemCache, root string, digest []byte) (io.ReadCloser, bool, error) {
+	reader, found, err := openFsEntryAt(c, root, digest, c.depth)
+	if found || err != nil || c.depth == DEFAULT_SHARD_DEPTH {
+		return reader, found, err
+	}
+	return openFsEntryAt(c, root, digest, DEFAULT_SHARD_DEPTH)
+}
+
+func openFsEntryAt(c *FileSystemCache, root string, digest []byte, depth int) (io.ReadCloser, bool, error) {
+	_, entryPath, err := defineShardedPath(root, digest, depth)
+	if err != nil {
+		return nil, false, err
+	}
+	file, err := os.Open(entryPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return nil, false, nil
 		} else {
-			return nil, err
+			return nil, false, err
 		}
 	}
 
-	source, err := os.Open(entryPath)
+	reader, err := newEntryReader(file)
 	if err != nil {
-		return nil, err
+		file.Close()
+		return nil, false, err
+	}
+	if reader.expiresAt != nil && !time.Now().Before(*reader.expiresAt) {
+		reader.Close()
+		if c.readOnly {
+			return nil, false, nil
+		}
+		if err := os.Remove(entryPath); err != nil && !os.IsNotExist(err) {
+			utils.Warnf("Error removing expired cache entry: %v", err)
+		}
+		return nil, false, nil
 	}
-	defer source.Close()
 
-	return ioutil.ReadAll(source)
+	// `Prune()` takes the last used time of an entry file from its modification time
+	if c.readOnly {
+		return reader, true, nil
+	}
+	now := time.Now()
+	if err := os.Chtimes(entryPath, now, now); err != nil {
+		utils.Debugf("Error updating cache entry: %v", err)
+	}
+	return reader, true, nil
 }
 
 // `Prune()` consolidates entries into the JSON file so we want to check that first.
 // A hit in the filesystem is a fallback and it means that `Prune()` has not run yet.
-func (c *FileSystemCache) FindEntry(digest []byte) ([]byte, error) {
-	if content := checkJsonEntry(c, digest); content != nil {
-		return content, nil
+// A corrupt entry in the JSON is only an error if there is no entry file either.
+func findEntryAt(ctx context.Context, c *FileSystemCache, root string, digest []byte) (io.ReadCloser, bool, error) {
+	content, found, jsonErr := checkJsonEntry(ctx, c, root, digest)
+	if found {
+		return ioutil.NopCloser(bytes.NewReader(content)), true, nil
+	}
+	reader, found, err := checkFsEntry(c, root, digest)
+	if err == nil && !found && jsonErr != nil {
+		return nil, false, jsonErr
 	}
-	return checkFsEntry(c, digest)
+	return reader, found, err
 }
 
-func (c *FileSystemCache) SaveEntry(digest []byte, content []byte) error {
-	entryRoot, entryPath := defineEntryPath(c.root, digest)
+// Read the content of an entry and close it.
+func readEntry(reader io.ReadCloser) ([]byte, error) {
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// Entries that are only found in the cache of earlier versions are copied
+// into the cache.
+func (c *FileSystemCache) findEntryReader(ctx context.Context, digest []byte) (io.ReadCloser, bool, error) {
+	reader, found, err := findEntryAt(ctx, c, c.root, digest)
+	if err != nil || found || len(c.legacyRoot) == 0 {
+		return reader, found, err
+	}
 
-	err := os.MkdirAll(entryRoot, 0755)
+	reader, found, err = findEntryAt(ctx, c, c.legacyRoot, digest)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	content, err := readEntry(reader)
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	if c.readOnly {
+		return ioutil.NopCloser(bytes.NewReader(content)), true, nil
+	}
+	if err := c.SaveEntry(ctx, digest, content); err != nil {
+		utils.Warnf("Error copying cache entry: %v", err)
 	}
+	return ioutil.NopCloser(bytes.NewReader(content)), true, nil
+}
+
+// Count a lookup in the stats, unless the cache is only looked up.
+func (c *FileSystemCache) recordLookup(hit bool, saved time.Duration) {
+	if !c.readOnly {
+		recordLookup(c.root, c.dirMode, c.fileMode, hit, saved)
+	}
+}
 
-	destination, err := os.Create(entryPath)
+// FindEntryReader is the streaming variant of `FindEntry()`. The content of an
+// entry file is only verified once it has been read completely, so reading a
+// corrupt entry fails with an error wrapping `ErrCorrupt`. Every lookup is
+// counted in the stats of the cache.
+func (c *FileSystemCache) FindEntryReader(ctx context.Context, digest []byte) (io.ReadCloser, bool, error) {
+	reader, found, err := c.findEntryReader(ctx, digest)
 	if err != nil {
-		return err
+		if errors.Is(err, ErrCorrupt) {
+			c.recordLookup(false, 0)
+		}
+		return nil, false, err
+	}
+
+	// the run time is part of the content, which is only read by the caller
+	c.recordLookup(found, 0)
+	return reader, found, nil
+}
+
+// Every lookup is counted in the stats of the cache. A corrupt entry counts as
+// a miss and is reported with an error wrapping `ErrCorrupt`, saving the entry
+// again replaces it.
+func (c *FileSystemCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	reader, found, err := c.findEntryReader(ctx, digest)
+	var content []byte
+	if err == nil && found {
+		content, err = readEntry(reader)
 	}
-	defer destination.Close()
-	_, err = destination.Write(content)
 	if err != nil {
-		return err
+		if errors.Is(err, ErrCorrupt) {
+			c.recordLookup(false, 0)
+		}
+		return nil, false, err
 	}
 
-	return nil
+	c.recordLookup(found, savedDuration(content))
+	return content, found, nil
 }
 
-func defineEntryPath(root string, digest []byte) (string, string) {
-	encodedDigest := hex.EncodeToString(digest)
-	entryRoot := path.Join(root, encodedDigest[0:2], encodedDigest[2:4])
-	entryPath := path.Join(entryRoot, encodedDigest[4:])
-	return entryRoot, entryPath
+// SaveEntryReader is the streaming variant of `SaveEntry()`. The entry
+// expires after the TTL set by CLANG_TIDY_CACHE_ENTRY_TTL, if any.
+func (c *FileSystemCache) SaveEntryReader(ctx context.Context, digest []byte, content io.Reader) error {
+	var expiresAt *time.Time
+	if c.ttl > 0 {
+		expiry := time.Now().Add(c.ttl)
+		expiresAt = &expiry
+	}
+	return c.saveEntry(digest, content, expiresAt)
 }
 
-// Remove cache entries that have not been used in the last `numWeeks` and
-// consolidate the remainder in a single JSON file. The consolidation helps
-// speed up later pruning since we only need to look up the single file.
-func Prune(numWeeks int) error {
-	root := GetFileSystemCachePath()
-	err := os.MkdirAll(root, 0755)
+// SaveEntries adds the entries to ENTRIES_FILE with a single write, rather
+// than writing a file per entry, or to ENTRIES_LOG_FILE if it is enabled.
+// Existing entries with the same digest are replaced, keeping their pin.
+func (c *FileSystemCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	if _, err := decodeEntryKeys(entries); err != nil {
+		return err
+	}
+	if err := utils.MkdirAllPerm(c.root, c.dirMode); err != nil {
+		return err
+	}
+
+	lock, err := lockEntries(c.root, true, c.fileMode)
 	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
 
-	// Populate `Entries` from the many files in the filesystem
-	entries := readJson(path.Join(root, ENTRIES_FILE))
-	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	stored, err := readJsonForRewrite(filepath.Join(c.root, ENTRIES_FILE))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var expiresAt *time.Time
+	if c.ttl > 0 {
+		expiry := now.Add(c.ttl)
+		expiresAt = &expiry
+	}
+	changed := []string{}
+	for key, content := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, err := newEntry(content, now, c.compression)
 		if err != nil {
 			return err
 		}
-		if info.IsDir() || info.Name() == ENTRIES_FILE {
-			return nil
+		entry.ExpiresAt = expiresAt
+		entry.Pinned = stored[key].Pinned
+		stored[key] = entry
+		changed = append(changed, key)
+	}
+
+	return updateJson(c.root, stored, changed, nil, c.fileMode, c.entriesLog)
+}
+
+func (c *FileSystemCache) saveEntry(digest []byte, content io.Reader, expiresAt *time.Time) error {
+	entryRoot, entryPath, err := defineShardedPath(c.root, digest, c.depth)
+	if err != nil {
+		return err
+	}
+
+	err = utils.MkdirAllPerm(entryRoot, c.dirMode)
+	if err != nil {
+		return err
+	}
+
+	err = writeEntryFile(entryPath, content, expiresAt, c.fileMode, c.compression)
+	// a concurrent prune may have removed the directory while it was empty
+	if os.IsNotExist(err) {
+		if seeker, ok := content.(io.Seeker); ok {
+			if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr == nil {
+				if err = utils.MkdirAllPerm(entryRoot, c.dirMode); err == nil {
+					err = writeEntryFile(entryPath, content, expiresAt, c.fileMode, c.compression)
+				}
+			}
 		}
-		content, err := ioutil.ReadFile(path)
-		if err != nil {
-			fmt.Println("Error reading file:", err)
-			return nil
+	}
+	return err
+}
+
+func (c *FileSystemCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	return c.SaveEntryReader(ctx, digest, bytes.NewReader(content))
+}
+
+func defineEntryPath(root string, digest []byte) (string, string, error) {
+	return defineShardedPath(root, digest, DEFAULT_SHARD_DEPTH)
+}
+
+// Split the digest over `depth` directories of two hex characters and the file
+// name, e.g. `ab/cd/efg...` for a depth of 2. Digests that leave no file name
+// are rejected, rather than ending up as the name of a directory.
+func defineShardedPath(root string, digest []byte, depth int) (string, string, error) {
+	encodedDigest := hex.EncodeToString(digest)
+	if len(encodedDigest) <= 2*depth {
+		return "", "", fmt.Errorf("Invalid digest %q, it is too short for %d directory levels", encodedDigest, depth)
+	}
+	entryRoot := root
+	for i := 0; i < depth; i++ {
+		entryRoot = filepath.Join(entryRoot, encodedDigest[2*i:2*i+2])
+	}
+	entryPath := filepath.Join(entryRoot, encodedDigest[2*depth:])
+	return entryRoot, entryPath, nil
+}
+
+// Check if the digest is the hex encoded SHA256 of an entry.
+func isEntryDigest(digest string) bool {
+	decoded, err := hex.DecodeString(digest)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// Reconstruct the digest from the path of an entry file, whatever the depth.
+func digestFromEntryPath(root string, entryPath string) string {
+	relPath, err := filepath.Rel(root, entryPath)
+	if err != nil {
+		return filepath.Base(entryPath)
+	}
+	return strings.ReplaceAll(filepath.ToSlash(relPath), "/", "")
+}
+
+// The number of bytes taken up by the content of the entry in the JSON files.
+func (e Entry) size() int64 {
+	return int64(len(e.Content) + len(e.Compressed))
+}
+
+// Get the keys of the entries, least recently used first.
+func keysByLastUsed(entries Entries) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].LastUsed.Before(entries[keys[j]].LastUsed)
+	})
+	return keys
+}
+
+// Evict the least recently used entries until the total size fits in maxSize.
+// Returns the remaining entries and the number of bytes reclaimed. Shared
+// content is only reclaimed along with the last entry using it.
+func pruneToSize(entries Entries, maxSize int64) (Entries, int64) {
+	keys := keysByLastUsed(entries)
+	totalSize := entries.size()
+
+	users := map[string]int{}
+	for _, entry := range entries {
+		users[entry.Checksum]++
+	}
+
+	prunedEntries := Entries{}
+	reclaimed := int64(0)
+	for _, key := range keys {
+		if totalSize-reclaimed > maxSize {
+			entry := entries[key]
+			users[entry.Checksum]--
+			if len(entry.Checksum) == 0 || users[entry.Checksum] == 0 {
+				reclaimed += entry.size()
+			}
+			continue
 		}
+		prunedEntries[key] = entries[key]
+	}
+	return prunedEntries, reclaimed
+}
+
+// Keep only the maxEntries most recently used entries.
+func pruneToCount(entries Entries, maxEntries int) Entries {
+	keys := keysByLastUsed(entries)
+	prunedEntries := Entries{}
+	for i := len(keys) - 1; i >= 0 && len(prunedEntries) < maxEntries; i-- {
+		prunedEntries[keys[i]] = entries[keys[i]]
+	}
+	return prunedEntries
+}
 
-		// The digest is split over 2 parent dir name and the file name, e.g. `ab/cd/efg...`
-		parent1 := filepath.Base(filepath.Dir(filepath.Dir(path)))
-		parent2 := filepath.Base(filepath.Dir(path))
-		digest := parent1 + parent2 + info.Name()
-		entries[digest] = Entry{Content: string(content), LastUsed: info.ModTime()}
+// Resolve the symbolic links in the path of the cache, so that walking it
+// descends into the directory rather than stopping at the link. A path that
+// does not exist is returned as it is.
+func resolveCacheRoot(root string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		return root, nil
+	}
+	return resolved, err
+}
 
-		// We no longer need the file since the content is going into JSON.
-		err = os.Remove(path)
-		if err != nil {
-			fmt.Println("Error deleting file:", err)
+// Check if the file is a symbolic link. Links below the root are never
+// followed, since they could point outside of the cache.
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// Remove the file or empty directory, which has to be below the (resolved) root.
+func removeCachePath(root string, path string) error {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Refusing to delete %s, which is outside of the cache %s", path, root)
+	}
+	return os.Remove(path)
+}
+
+// Remove the (shard) directories below root that are empty, deepest first.
+func removeEmptyDirs(root string) {
+	dirs := []string{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != root {
+			if isNamespacesDir(root, path) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
 		}
 		return nil
 	})
+
+	// children are visited after their parents, so walk the list backwards
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if entries, err := os.ReadDir(dirs[i]); err == nil && len(entries) == 0 {
+			if err := removeCachePath(root, dirs[i]); err != nil && !os.IsNotExist(err) {
+				// another process may have saved an entry in the meantime
+				if entries, readErr := os.ReadDir(dirs[i]); readErr == nil && len(entries) > 0 {
+					continue
+				}
+				utils.Warnf("Error deleting path: %v", err)
+			}
+		}
+	}
+}
+
+type entryFile struct {
+	path string
+	info os.FileInfo
+}
+
+// Read the entry from one of the files in the filesystem, compressing its
+// content with the codec.
+func readEntryFile(root string, file entryFile, codec string) (string, Entry, error) {
+	data, err := ioutil.ReadFile(file.path)
 	if err != nil {
-		return err
+		return "", Entry{}, fmt.Errorf("Error reading file: %v", err)
+	}
+	content, expiresAt, err := decodeEntryFile(data)
+	if err != nil {
+		return "", Entry{}, fmt.Errorf("Error decoding file %s: %w", file.path, err)
 	}
 
-	// Remove all the directories as well now that they are empty
-	paths, err := os.ReadDir(root)
+	// The digest is split over the parent dir names and the file name, e.g. `ab/cd/efg...`
+	digest := digestFromEntryPath(root, file.path)
+	entry, err := newEntry(content, file.info.ModTime(), codec)
 	if err != nil {
-		return err
+		return "", Entry{}, fmt.Errorf("Error compressing file: %v", err)
 	}
-	for _, pathInfo := range paths {
-		if !pathInfo.IsDir() {
-			continue
+	entry.ExpiresAt = expiresAt
+
+	return digest, entry, nil
+}
+
+// Read the files into `entries` using one worker per CPU. Returns the paths of
+// the files that were read successfully or turned out to be corrupt, or the
+// error of `ctx` when it is cancelled before all the files have been read.
+func consolidateEntryFiles(ctx context.Context, root string, entries Entries, files []entryFile, codec string) ([]string, error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	consolidated := []string{}
+
+	jobs := make(chan entryFile)
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				digest, entry, err := readEntryFile(root, file, codec)
+				if err != nil {
+					utils.Warnf("%v", err)
+					// corrupt files can never be read, so they are removed as well
+					if errors.Is(err, ErrCorrupt) {
+						mutex.Lock()
+						consolidated = append(consolidated, file.path)
+						mutex.Unlock()
+					}
+					continue
+				}
+
+				mutex.Lock()
+				// the file of an entry that was used again does not know about its pin
+				entry.Pinned = entry.Pinned || entries[digest].Pinned
+				entries[digest] = entry
+				consolidated = append(consolidated, file.path)
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	err := ctx.Err()
+feed:
+	for _, file := range files {
+		select {
+		case jobs <- file:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
 		}
+	}
+	close(jobs)
+	wg.Wait()
 
-		if err := os.RemoveAll(filepath.Join(root, pathInfo.Name())); err != nil {
-			fmt.Println("Error deleting path:", err)
-			return err
+	return consolidated, err
+}
+
+// Get the total size of the entries in bytes, counting shared content once.
+func (entries Entries) size() int64 {
+	totalSize := int64(0)
+	counted := map[string]bool{}
+	for _, value := range entries {
+		if len(value.Checksum) > 0 {
+			if counted[value.Checksum] {
+				continue
+			}
+			counted[value.Checksum] = true
 		}
+		totalSize += value.size()
+	}
+	return totalSize
+}
+
+// Select the entries that are kept by a prune: those used within `maxAge`,
+// limited to the `maxEntries` and `maxSize` most recently used ones
+// when these are not zero. Pinned entries are always kept, and are not counted
+// against the limits. What is removed is reported, as what would be removed
+// with `dryRun`.
+func selectEntries(entries Entries, maxAge time.Duration, maxEntries int, maxSize int64, dryRun bool) Entries {
+	removed := "Removed"
+	if dryRun {
+		removed = "Would remove"
 	}
 
-	// Keep only the most recent entries
+	// Keep only the most recent entries that have not expired
 	now := time.Now()
-	duration := time.Duration(numWeeks*7*24) * time.Hour
 	prunedEntries := Entries{}
+	pinnedEntries := Entries{}
+	expired := 0
 	for key, value := range entries {
-		if now.Sub(value.LastUsed) <= duration {
+		if value.Pinned {
+			pinnedEntries[key] = value
+		} else if value.expired(now) {
+			expired++
+		} else if now.Sub(value.LastUsed) <= maxAge {
 			prunedEntries[key] = value
 		}
 	}
 
-	fmt.Println("Found", len(entries), "cache entries in", root)
-	diff := len(entries) - len(prunedEntries)
+	diff := len(entries) - len(prunedEntries) - len(pinnedEntries) - expired
 	if diff == 0 {
 		fmt.Println("No outdated entries")
 	} else {
-		fmt.Println("Removed", diff, "outdated cache entries")
+		fmt.Println(removed, diff, "outdated cache entries")
+	}
+	if expired > 0 {
+		fmt.Println(removed, expired, "expired cache entries")
+	}
+
+	// Keep only the most recently used entries up to the maximum number
+	if maxEntries > 0 && len(prunedEntries) > maxEntries {
+		numEntries := len(prunedEntries)
+		prunedEntries = pruneToCount(prunedEntries, maxEntries)
+		fmt.Println(removed, numEntries-len(prunedEntries), "least recently used cache entries to keep", maxEntries, "entries")
+	}
+
+	// Keep only the most recently used entries that fit in the size budget
+	if maxSize > 0 {
+		numEntries := len(prunedEntries)
+		var reclaimed int64
+		prunedEntries, reclaimed = pruneToSize(prunedEntries, maxSize)
+		if reclaimed > 0 {
+			fmt.Println(removed, numEntries-len(prunedEntries), "least recently used cache entries, reclaiming", reclaimed, "bytes")
+		}
 	}
 
-	// Write to JSON
-	jsonData, err := json.MarshalIndent(prunedEntries, "", "  ")
+	if len(pinnedEntries) > 0 {
+		fmt.Println("Kept", len(pinnedEntries), "pinned cache entries")
+	}
+	for key, value := range pinnedEntries {
+		prunedEntries[key] = value
+	}
+
+	if dryRun {
+		fmt.Println(removed, len(entries)-len(prunedEntries), "cache entries in total, reclaiming", entries.size()-prunedEntries.size(), "bytes")
+	}
+	return prunedEntries
+}
+
+// Remove cache entries that have not been used in the last `numWeeks`, see
+// `PruneMaxAge()`.
+func Prune(ctx context.Context, numWeeks int, dryRun bool) error {
+	return PruneMaxAge(ctx, time.Duration(numWeeks)*WEEK, dryRun)
+}
+
+// Remove cache entries that have not been used within `maxAge` and
+// consolidate the remainder in a single JSON file, with the settings of
+// `SetFsConfiguration()`. The consolidation helps speed up later pruning since
+// we only need to look up the single file. If `GetMaxCacheEntries()` or
+// `GetMaxCacheSize()` are set, the least recently used entries are removed
+// afterwards until the cache fits. With `dryRun`, only report what would be
+// removed without touching the cache. Cancelling `ctx` stops the prune before
+// the cache is modified. A cache with fewer entries than
+// `GetMinCacheEntries()` is left alone, since that is more likely a
+// misconfigured directory than a cache that is empty. Only one prune runs at a
+// time, another one fails rather than waiting for it to finish.
+func PruneMaxAge(ctx context.Context, maxAge time.Duration, dryRun bool) error {
+	return pruneFs(ctx, &fsConfig, maxAge, dryRun)
+}
+
+// Prune the filesystem cache with the settings, see `PruneMaxAge()`.
+func pruneFs(ctx context.Context, settings *FsConfiguration, maxAge time.Duration, dryRun bool) error {
+	maxEntries, err := settings.GetMaxCacheEntries()
+	if err != nil {
+		return err
+	}
+	maxSize, err := settings.GetMaxCacheSize()
+	if err != nil {
+		return err
+	}
+	minEntries, err := settings.GetMinCacheEntries()
+	if err != nil {
+		return err
+	}
+
+	root := settings.GetFileSystemCachePath()
+	fileMode := settings.GetFileMode()
+	if _, err := os.Stat(root); os.IsNotExist(err) && minEntries > 0 {
+		utils.Warnf("The cache directory %s does not exist, not pruning", root)
+		return nil
+	}
+	err = utils.MkdirAllPerm(root, settings.GetDirMode())
+	if err != nil {
+		return err
+	}
+	root, err = resolveCacheRoot(root)
+	if err != nil {
+		return err
+	}
+
+	// A dry run does not change the cache, so it does not need to keep out other prunes
+	if !dryRun {
+		pruneLock, err := utils.TryLockFile(filepath.Join(root, PRUNE_LOCK_FILE), fileMode)
+		if errors.Is(err, utils.ErrLocked) {
+			return fmt.Errorf("Another prune of %s is in progress", root)
+		}
+		if err != nil {
+			return err
+		}
+		defer pruneLock.Unlock()
+	}
+
+	// Keep other processes from reading the JSON while it is being rewritten
+	lock, err := lockEntries(root, true, fileMode)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Populate `Entries` from the many files in the filesystem. The JSON is
+	// rewritten from scratch, so a JSON that can not be read stops the prune
+	// rather than losing its entries.
+	entries, err := readJsonForRewrite(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		return fmt.Errorf("Not pruning, %v", err)
+	}
+	files := []entryFile{}
+	staleFiles := []string{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() && isNamespacesDir(root, path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || isCacheMetadata(root, path) {
+			return nil
+		}
+		if isSymlink(info) {
+			utils.Warnf("Skipping %s, which is a symbolic link", path)
+			return nil
+		}
+		// Leftovers of interrupted writes are removed, unless they could still
+		// belong to a write in progress
+		if strings.HasSuffix(info.Name(), utils.TEMP_SUFFIX) {
+			if time.Since(info.ModTime()) > STALE_TEMP_FILE_AGE {
+				staleFiles = append(staleFiles, path)
+			}
+			return nil
+		}
+		// Files that are not named after a digest are no entries, copies of the
+		// metadata in a shard directory are never read and can be removed
+		if !isEntryDigest(digestFromEntryPath(root, path)) {
+			if name := info.Name(); name == ENTRIES_FILE || name == BODIES_FILE || name == ENTRIES_LOG_FILE {
+				fmt.Println("Removing stray", path)
+				staleFiles = append(staleFiles, path)
+			} else {
+				utils.Warnf("Skipping %s, which is not a cache entry", path)
+			}
+			return nil
+		}
+		files = append(files, entryFile{path: path, info: info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// We no longer need the files once the content has gone into JSON.
+	consolidated, err := consolidateEntryFiles(ctx, root, entries, files, settings.GetCompression())
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path.Join(root, ENTRIES_FILE), jsonData, 0644)
+	consolidated = append(consolidated, staleFiles...)
+
+	fmt.Println("Found", len(entries), "cache entries in", root)
+	if len(entries) < minEntries {
+		utils.Warnf("Expected at least %d cache entries in %s, not pruning. Check that the cache directory is right, "+
+			"or lower CLANG_TIDY_CACHE_PRUNE_MIN_ENTRIES", minEntries, root)
+		return nil
+	}
+	prunedEntries := selectEntries(entries, maxAge, maxEntries, maxSize, dryRun)
+	if dryRun {
+		return nil
+	}
+
+	// Past this point the prune runs to completion to keep the cache consistent
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Write to JSON, which compacts the log into it
+	err = compactJson(root, prunedEntries, fileMode)
+	if err != nil {
+		return err
+	}
+
+	// Only remove the files that made it into the JSON, anything that could
+	// not be read is left in place for a later prune to retry
+	for _, entryPath := range consolidated {
+		if err := removeCachePath(root, entryPath); err != nil {
+			utils.Warnf("Error deleting file: %v", err)
+		}
+	}
+
+	removeEmptyDirs(root)
+
+	return nil
+}
+
+// Remove all of the entries from the cache, both the files and the JSON. The
+// stats and the audit log are kept.
+func Clear(ctx context.Context) error {
+	root := fsConfig.GetFileSystemCachePath()
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		fmt.Println("No cache entries in", root)
+		return nil
+	}
+	root, err := resolveCacheRoot(root)
+	if err != nil {
+		return err
+	}
+
+	// Keep other processes from reading the JSON while it is being removed
+	lock, err := lockEntries(root, true, fsConfig.GetFileMode())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	digests := map[string]bool{}
+	entries, err := readJson(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		utils.Warnf("%v", err)
+	}
+	for digest := range entries {
+		digests[digest] = true
+	}
+	files := []string{}
+	freed := int64(0)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() && isNamespacesDir(root, path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if isSymlink(info) {
+			utils.Warnf("Skipping %s, which is a symbolic link", path)
+			return nil
+		}
+		name := info.Name()
+		if isCacheMetadata(root, path) && (name == ENTRIES_FILE || name == BODIES_FILE || name == ENTRIES_LOG_FILE || isCorruptJson(name)) {
+			files = append(files, path)
+			freed += info.Size()
+			return nil
+		}
+		if isCacheMetadata(root, path) {
+			return nil
+		}
+		// Temporary files could still belong to a write in progress
+		if strings.HasSuffix(info.Name(), utils.TEMP_SUFFIX) {
+			if time.Since(info.ModTime()) > STALE_TEMP_FILE_AGE {
+				files = append(files, path)
+				freed += info.Size()
+			}
+			return nil
+		}
+		digests[digestFromEntryPath(root, path)] = true
+		files = append(files, path)
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range files {
+		if err := removeCachePath(root, filePath); err != nil {
+			utils.Warnf("Error deleting file: %v", err)
+		}
+	}
+	removeEmptyDirs(root)
+
+	fmt.Println("Removed", len(digests), "cache entries from", root, "freeing", freed, "bytes")
+	return nil
 }
@@ -0,0 +1,242 @@
+package caches
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// The digest of an entry with the content.
+func testDigest(content string) []byte {
+	digest := sha256.Sum256([]byte(content))
+	return digest[:]
+}
+
+func TestDigestFromEntryPath(t *testing.T) {
+	for _, depth := range []int{0, 2, 3} {
+		depth := depth
+		root := t.TempDir()
+		cache := NewFsCache(&FsConfiguration{CacheDir: root, ShardDepth: &depth})
+
+		saved := map[string]bool{}
+		for _, content := range []string{"first", "second", "third"} {
+			digest := testDigest(content)
+			if err := cache.SaveEntry(context.Background(), digest, []byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			saved[hex.EncodeToString(digest)] = true
+		}
+
+		found := map[string]bool{}
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			if digest := digestFromEntryPath(root, path); isEntryDigest(digest) {
+				found[digest] = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != len(saved) {
+			t.Errorf("depth %d: found %d entry files, want %d", depth, len(found), len(saved))
+		}
+		for digest := range saved {
+			if !found[digest] {
+				t.Errorf("depth %d: no entry file for %s", depth, digest)
+			}
+		}
+	}
+}
+
+func TestDigestFromEntryPathSeparators(t *testing.T) {
+	root := t.TempDir()
+	digest := hex.EncodeToString(testDigest("content"))
+	paths := []string{
+		filepath.Join(root, digest[:2], digest[2:4], digest[4:]),
+		root + "/" + digest[:2] + "/" + digest[2:4] + "/" + digest[4:],
+	}
+	// only Windows treats a backslash as a separator
+	if runtime.GOOS == "windows" {
+		paths = append(paths, root+`\`+digest[:2]+`\`+digest[2:4]+`\`+digest[4:])
+	}
+	for _, path := range paths {
+		if got := digestFromEntryPath(root, path); got != digest {
+			t.Errorf("%s: got digest %q, want %q", path, got, digest)
+		}
+	}
+
+	// a file outside of the shard directories keeps its name
+	if got := digestFromEntryPath(root, filepath.Join(root, ENTRIES_FILE)); got != ENTRIES_FILE {
+		t.Errorf("got %q for %s", got, ENTRIES_FILE)
+	}
+}
+
+func TestDefineShardedPath(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name   string
+		digest string
+		depth  int
+		path   string
+	}{
+		{"empty", "", 2, ""},
+		{"1 byte", "ab", 2, ""},
+		{"2 bytes", "abcd", 2, ""},
+		{"3 bytes", "abcdef", 2, filepath.Join("ab", "cd", "ef")},
+		{"1 byte without directories", "ab", 0, "ab"},
+		{"2 bytes in 1 directory", "abcd", 1, filepath.Join("ab", "cd")},
+		{"3 bytes in 1 directory", "abcdef", 1, filepath.Join("ab", "cdef")},
+		{"4 bytes in 3 directories", "abcdef01", 3, filepath.Join("ab", "cd", "ef", "01")},
+	}
+	for _, test := range tests {
+		digest, err := hex.DecodeString(test.digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entryRoot, entryPath, err := defineShardedPath(root, digest, test.depth)
+		if len(test.path) == 0 {
+			if err == nil {
+				t.Errorf("%s: got the path %s, want an error", test.name, entryPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if want := filepath.Join(root, test.path); entryPath != want {
+			t.Errorf("%s: got the path %s, want %s", test.name, entryPath, want)
+		}
+		if filepath.Dir(entryPath) != entryRoot {
+			t.Errorf("%s: the path %s is not in %s", test.name, entryPath, entryRoot)
+		}
+	}
+}
+
+// Write a file into the cache, creating its directories.
+func writeCacheFile(t *testing.T, root string, name string, content string) string {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPruneShortFileNames(t *testing.T) {
+	root := t.TempDir()
+	minEntries := 0
+	settings := &FsConfiguration{CacheDir: root, Prune: PruneConfiguration{MinEntries: &minEntries}}
+	digest := testDigest("content")
+	if err := NewFsCache(settings).SaveEntry(context.Background(), digest, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	// names that do not make up a digest, also of an odd number of hex characters
+	shortFiles := []string{"a", "abc", "abcd", "ab/c", "ab/cd/e", "ab/cd/ef"}
+	for _, name := range shortFiles {
+		writeCacheFile(t, root, name, "short")
+	}
+
+	if err := pruneFs(context.Background(), settings, 4*WEEK, false); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readJsonForRewrite(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries[hex.EncodeToString(digest)]; !ok || len(entries) != 1 {
+		t.Errorf("got the entries %v, want only %x", keysByLastUsed(entries), digest)
+	}
+	for _, name := range shortFiles {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestPruneRemovesStrayJson(t *testing.T) {
+	root := t.TempDir()
+	minEntries := 0
+	settings := &FsConfiguration{CacheDir: root, Prune: PruneConfiguration{MinEntries: &minEntries}}
+	digest := testDigest("content")
+	if err := NewFsCache(settings).SaveEntry(context.Background(), digest, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	stray := writeCacheFile(t, root, "ab/cd/"+ENTRIES_FILE, `{"version": 2, "entries": {}}`)
+
+	if err := pruneFs(context.Background(), settings, 4*WEEK, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("the stray %s is still there", stray)
+	}
+	entries, err := readJsonForRewrite(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries[hex.EncodeToString(digest)]; !ok {
+		t.Errorf("the entry %x is missing from %s", digest, ENTRIES_FILE)
+	}
+}
+
+func TestPruneRemoteBackend(t *testing.T) {
+	for _, tiered := range []bool{false, true} {
+		root := t.TempDir()
+		minEntries := 0
+		cfg := &Configuration{
+			Backend:         "redis",
+			Tiered:          tiered,
+			RedisConfig:     &RedisConfiguration{Address: "localhost:0"},
+			FsConfiguration: FsConfiguration{CacheDir: root, Prune: PruneConfiguration{MinEntries: &minEntries}},
+		}
+		digest := testDigest("content")
+		if err := NewFsCache(&cfg.FsConfiguration).SaveEntry(context.Background(), digest, []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+
+		// the local cache is only pruned when it is the local copy of the remote
+		err := newPruner(cfg, &cfg.FsConfiguration).Prune(context.Background(), 4*WEEK, false)
+		_, statErr := os.Stat(filepath.Join(root, ENTRIES_FILE))
+		if tiered {
+			if err != nil || statErr != nil {
+				t.Errorf("tiered: got %v, want the local cache pruned: %v", err, statErr)
+			}
+		} else if err == nil || !os.IsNotExist(statErr) {
+			t.Errorf("got %v, want an error without pruning the local cache", err)
+		}
+	}
+}
+
+func BenchmarkPrune(b *testing.B) {
+	const entryCount = 1000
+	minEntries := 0
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		settings := &FsConfiguration{CacheDir: b.TempDir(), Prune: PruneConfiguration{MinEntries: &minEntries}}
+		cache := NewFsCache(settings)
+		for j := 0; j < entryCount; j++ {
+			content := fmt.Sprintf("entry %d of %d", j, i)
+			if err := cache.SaveEntry(context.Background(), testDigest(content), []byte(content)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		if err := pruneFs(context.Background(), settings, 4*WEEK, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package caches
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Problems found by `Check()`
+type fsckReport struct {
+	problems int
+	repaired int
+}
+
+// Print a problem, along with what was done about it when it was repaired.
+func (r *fsckReport) report(fixed string, format string, args ...interface{}) {
+	r.problems++
+	message := fmt.Sprintf(format, args...)
+	if len(fixed) > 0 {
+		r.repaired++
+		message += " (" + fixed + ")"
+	}
+	fmt.Println(message)
+}
+
+// Remove the file when repairing and tell what was done.
+func removeForRepair(repair bool, root string, path string) string {
+	if !repair {
+		return ""
+	}
+	if err := removeCachePath(root, path); err != nil && !os.IsNotExist(err) {
+		utils.Warnf("Error deleting file: %v", err)
+		return ""
+	}
+	return "removed"
+}
+
+// Move a JSON file aside when repairing and tell what was done.
+func moveAsideForRepair(repair bool, jsonPath string) string {
+	if !repair {
+		return ""
+	}
+	quarantineJson(jsonPath)
+	if _, err := os.Stat(jsonPath); !os.IsNotExist(err) {
+		return ""
+	}
+	return "moved aside"
+}
+
+// Check the entries consolidated in ENTRIES_FILE and their bodies in
+// BODIES_FILE, along with the records of ENTRIES_LOG_FILE, and return the
+// number of entries.
+func checkJsonFiles(root string, repair bool, report *fsckReport) (int, error) {
+	entriesPath := filepath.Join(root, ENTRIES_FILE)
+	bodiesPath := filepath.Join(root, BODIES_FILE)
+
+	file := entriesFile{Entries: Entries{}}
+	if err := readJsonFile(entriesPath, &file); err != nil {
+		if !errors.Is(err, errCorruptJson) {
+			return 0, err
+		}
+		report.report(moveAsideForRepair(repair, entriesPath), "%v", err)
+		// the bodies are of no use without their entries, keep them together for inspection
+		if _, err := os.Stat(bodiesPath); err == nil {
+			moveAsideForRepair(repair, bodiesPath)
+		}
+		return 0, nil
+	}
+
+	bodies := Bodies{}
+	if err := readJsonFile(bodiesPath, &bodies); err != nil {
+		if !errors.Is(err, errCorruptJson) {
+			return 0, err
+		}
+		report.report(moveAsideForRepair(repair, bodiesPath), "%v", err)
+	}
+
+	// the bodies of entries that the log replaces are in use until it is compacted
+	used := map[string]bool{}
+	for _, entry := range file.Entries {
+		if len(entry.Body) > 0 {
+			used[entry.Body] = true
+		}
+	}
+	skipped, err := applyEntriesLog(root, file.Entries)
+	if err != nil {
+		return 0, err
+	}
+	for range skipped {
+		report.report(removeFromJson(repair), "A record of %s can not be decoded", ENTRIES_LOG_FILE)
+	}
+
+	intact := Entries{}
+	for key, entry := range file.Entries {
+		if !isEntryDigest(key) {
+			report.report(removeFromJson(repair), "Entry %s in %s has an invalid digest", key, ENTRIES_FILE)
+			continue
+		}
+		if len(entry.Body) > 0 {
+			body, exists := bodies[entry.Body]
+			if !exists {
+				report.report(removeFromJson(repair), "Entry %s in %s has no body in %s", key, ENTRIES_FILE, BODIES_FILE)
+				continue
+			}
+			entry = entry.withBody(body)
+		}
+		if _, err := entry.content(); err != nil {
+			report.report(removeFromJson(repair), "Entry %s in %s: %v", key, ENTRIES_FILE, err)
+			continue
+		}
+		intact[key] = entry
+	}
+	unused := 0
+	for checksum := range bodies {
+		if !used[checksum] {
+			report.report(removeFromJson(repair), "Body %s in %s is not used by any entry", checksum, BODIES_FILE)
+			unused++
+		}
+	}
+
+	// writing the intact entries drops the unused bodies and the log as well
+	if repair && (len(intact) < len(file.Entries) || unused > 0 || len(skipped) > 0) {
+		if err := compactJson(root, intact, fsConfig.GetFileMode()); err != nil {
+			return 0, err
+		}
+	}
+	return len(file.Entries), nil
+}
+
+// Entries are removed from the JSON by rewriting it once all of them are checked.
+func removeFromJson(repair bool) string {
+	if repair {
+		return "removed"
+	}
+	return ""
+}
+
+// Check the entry files that have not been consolidated yet, and return
+// their number. Files that do not belong to the cache are only reported.
+func checkEntryFiles(ctx context.Context, root string, codec string, repair bool, report *fsckReport) (int, error) {
+	count := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() && isNamespacesDir(root, path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || isSymlink(info) || isCacheMetadata(root, path) {
+			return nil
+		}
+		// Temporary files could still belong to a write in progress
+		if strings.HasSuffix(info.Name(), utils.TEMP_SUFFIX) {
+			if time.Since(info.ModTime()) > STALE_TEMP_FILE_AGE {
+				report.report(removeForRepair(repair, root, path), "Leftover temporary file %s", path)
+			}
+			return nil
+		}
+		if !isEntryDigest(digestFromEntryPath(root, path)) {
+			report.report("", "File %s is not part of the cache", path)
+			return nil
+		}
+
+		count++
+		if _, _, err := readEntryFile(root, entryFile{path: path, info: info}, codec); err != nil {
+			report.report(removeForRepair(repair, root, path), "%v", err)
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Check verifies the filesystem cache of `SetFsConfiguration()`, e.g. after a crash: ENTRIES_FILE and
+// BODIES_FILE have to decode, every entry in them and every entry file has to
+// be intact, and no other files should be left over. With `repair`, corrupt
+// entries, unused bodies and stale temporary files are removed, and a JSON
+// file that can not be decoded is moved aside like a lookup would do. Files
+// that do not belong to the cache are only reported. The problems that were
+// not repaired are counted in the result.
+func Check(ctx context.Context, repair bool) (int, error) {
+	root := fsConfig.GetFileSystemCachePath()
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		fmt.Println("No cache in", root)
+		return 0, nil
+	}
+	root, err := resolveCacheRoot(root)
+	if err != nil {
+		return 0, err
+	}
+
+	// A repair rewrites the JSON, which a prune must not do at the same time
+	if repair {
+		pruneLock, err := utils.TryLockFile(filepath.Join(root, PRUNE_LOCK_FILE), fsConfig.GetFileMode())
+		if errors.Is(err, utils.ErrLocked) {
+			return 0, fmt.Errorf("A prune of %s is in progress", root)
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer pruneLock.Unlock()
+	}
+
+	lock, err := lockEntries(root, repair, fsConfig.GetFileMode())
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+
+	report := &fsckReport{}
+	entries, err := checkJsonFiles(root, repair, report)
+	if err != nil {
+		return 0, err
+	}
+	files, err := checkEntryFiles(ctx, root, fsConfig.GetCompression(), repair, report)
+	if err != nil {
+		return 0, err
+	}
+	if repair {
+		removeEmptyDirs(root)
+	}
+
+	fmt.Println("Checked", entries, "entries in", ENTRIES_FILE, "and", files, "entry files in", root)
+	fmt.Println("Found", report.problems, "problems, repaired", report.repaired)
+	return report.problems - report.repaired, nil
+}
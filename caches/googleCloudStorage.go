@@ -4,20 +4,27 @@ import (
 	"cloud.google.com/go/storage"
 	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"time"
+
+	"google.golang.org/api/googleapi"
 )
 
 type GcsConfiguration struct {
 	BucketId string `json:"bucket_id"`
+	// Optional prefix prepended to all of the object names, e.g. `ctcache/`
+	Prefix string `json:"prefix"`
 }
 
 type GoogleCloudStorageCache struct {
+	remoteSettings
 	cfg    *GcsConfiguration
-	ctx    context.Context
 	client *storage.Client
 }
 
-func NewGcsCache(cfg *GcsConfiguration) (*GoogleCloudStorageCache, error) {
+func NewGcsCache(cfg *GcsConfiguration, settings *FsConfiguration) (*GoogleCloudStorageCache, error) {
 
 	// create the context
 	ctx := context.Background()
@@ -30,43 +37,121 @@ func NewGcsCache(cfg *GcsConfiguration) (*GoogleCloudStorageCache, error) {
 
 	// create the cache
 	cache := &GoogleCloudStorageCache{
-		cfg:    cfg,
-		ctx:    ctx,
-		client: client,
+		remoteSettings: newRemoteSettings(settings),
+		cfg:            cfg,
+		client:         client,
 	}
 
 	return cache, nil
 }
 
-func (c *GoogleCloudStorageCache) FindEntry(digest []byte) ([]byte, error) {
-	objectName := hex.EncodeToString(digest)
+func (c *GoogleCloudStorageCache) defineObjectName(digest []byte) (string, error) {
+	key, err := c.defineObjectKey(digest)
+	if err != nil {
+		return "", err
+	}
+	return c.cfg.Prefix + key, nil
+}
 
-	// attempt to read the entry from the bucket
-	source, err := c.client.Bucket(c.cfg.BucketId).Object(objectName).NewReader(c.ctx)
+func (c *GoogleCloudStorageCache) readObject(ctx context.Context, objectName string) ([]byte, bool, error) {
+	source, err := c.client.Bucket(c.cfg.BucketId).Object(objectName).NewReader(ctx)
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
-			return nil, nil
+			return nil, false, nil
 		} else {
-			return nil, err
+			return nil, false, err
 		}
 	}
 	defer source.Close()
 
-	return ioutil.ReadAll(source)
+	content, err := ioutil.ReadAll(source)
+	if err != nil {
+		return nil, false, err
+	}
+	return content, true, nil
 }
 
-func (c *GoogleCloudStorageCache) SaveEntry(digest []byte, content []byte) error {
-	objectName := hex.EncodeToString(digest)
+// Read the object, retrying failures.
+func (c *GoogleCloudStorageCache) readObjectWithRetries(ctx context.Context, objectName string) ([]byte, bool, error) {
+	var content []byte
+	found := false
+	err := c.withRetries(ctx, func() error {
+		var err error
+		content, found, err = c.readObject(ctx, objectName)
+		return err
+	})
+	return content, found, err
+}
 
-	wc := c.client.Bucket(c.cfg.BucketId).Object(objectName).NewWriter(c.ctx)
-	_, err := wc.Write(content)
+// Any response of the server is an answer, e.g. when the credentials only
+// allow access to the objects.
+func (c *GoogleCloudStorageCache) Ping(ctx context.Context) error {
+	_, err := c.client.Bucket(c.cfg.BucketId).Attrs(ctx)
+	var apiErr *googleapi.Error
+	if err == storage.ErrBucketNotExist || errors.As(err, &apiErr) {
+		return nil
+	}
+	return err
+}
+
+// Errors are retried, then reported as `ErrBackendUnavailable`.
+func (c *GoogleCloudStorageCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	objectName, err := c.defineObjectName(digest)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	if err := wc.Close(); err != nil {
+	// attempt to read the entry from the bucket
+	content, found, err := c.readObjectWithRetries(ctx, objectName)
+
+	// fall back to the flat object names used by earlier versions, which had no namespaces
+	if err == nil && !found && len(c.namespace) == 0 {
+		content, found, err = c.readObjectWithRetries(ctx, c.cfg.Prefix+hex.EncodeToString(digest))
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: GCS: %v", ErrBackendUnavailable, err)
+	}
+
+	return content, found, nil
+}
+
+func (c *GoogleCloudStorageCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	objectName, err := c.defineObjectName(digest)
+	if err != nil {
 		return err
 	}
 
+	err = c.withRetries(ctx, func() error {
+		wc := c.client.Bucket(c.cfg.BucketId).Object(objectName).NewWriter(ctx)
+		if _, err := wc.Write(content); err != nil {
+			wc.Close()
+			return err
+		}
+		return wc.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("%w: GCS: %v", ErrBackendUnavailable, err)
+	}
+
+	return nil
+}
+
+// Set the `CustomTime` of the objects to now, so that lifecycle rules can
+// remove the entries based on `daysSinceCustomTime`. Objects that only exist
+// under the legacy flat name are not touched.
+func (c *GoogleCloudStorageCache) TouchEntries(ctx context.Context, digests [][]byte) error {
+	now := time.Now()
+	for _, digest := range digests {
+		objectName, err := c.defineObjectName(digest)
+		if err != nil {
+			return err
+		}
+		object := c.client.Bucket(c.cfg.BucketId).Object(objectName)
+		_, err = object.Update(ctx, storage.ObjectAttrsToUpdate{CustomTime: now})
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+
 	return nil
 }
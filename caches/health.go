@@ -0,0 +1,75 @@
+package caches
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Time the remote cache has to answer the check at startup
+const REMOTE_PING_TIMEOUT = 2 * time.Second
+
+// Empty file of which the modification time is the time the remote cache was
+// last found unreachable
+const REMOTE_DOWN_FILE = "remote.down"
+
+// After the remote cache was found unreachable, it is not checked again for
+// this long, so that the runs of a build only log it once
+const REMOTE_DOWN_INTERVAL = time.Minute
+
+// Pinger is implemented by the remote caches that can check whether their
+// server can be reached without looking up an entry.
+type Pinger interface {
+	// Check that the server answers. An error response of the server, e.g.
+	// because the credentials do not allow the check itself, still counts as
+	// an answer.
+	Ping(ctx context.Context) error
+}
+
+// Check if the remote cache can be used at startup. An unreachable remote is
+// logged, and remembered in REMOTE_DOWN_FILE in the filesystem cache directory
+// of the settings for REMOTE_DOWN_INTERVAL, so that the processes started
+// meanwhile use the filesystem cache right away.
+func isRemoteReachable(remote Cacher, settings *FsConfiguration) bool {
+	pinger, ok := remote.(Pinger)
+	if !ok {
+		return true
+	}
+
+	root := settings.GetFileSystemCachePath()
+	downPath := filepath.Join(root, REMOTE_DOWN_FILE)
+	if info, err := os.Stat(downPath); err == nil && time.Since(info.ModTime()) < REMOTE_DOWN_INTERVAL {
+		utils.Debugf("The remote cache was unreachable %v ago, using the filesystem cache", time.Since(info.ModTime()).Round(time.Second))
+		return false
+	}
+
+	// not every client honours the deadline of the context while connecting
+	ctx, cancel := context.WithTimeout(context.Background(), REMOTE_PING_TIMEOUT)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- pinger.Ping(ctx) }()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		return true
+	}
+
+	utils.Warnf("The remote cache is unreachable, using the filesystem cache: %v", err)
+	if !settings.IsReadOnly() {
+		writeErr := utils.MkdirAllPerm(root, settings.GetDirMode())
+		if writeErr == nil {
+			writeErr = utils.WriteFileAtomic(downPath, nil, settings.GetFileMode())
+		}
+		if writeErr != nil {
+			utils.Debugf("Error remembering the unreachable remote cache: %v", writeErr)
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package caches
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DEFAULT_HTTP_TIMEOUT = 10
+
+type HttpConfiguration struct {
+	Url string `json:"url"`
+	// Optional bearer token sent in the `Authorization` header
+	Token string `json:"token"`
+	// Timeout of each request in seconds
+	Timeout int `json:"timeout"`
+}
+
+type HttpCache struct {
+	remoteSettings
+	cfg    *HttpConfiguration
+	client *http.Client
+}
+
+func NewHttpCache(cfg *HttpConfiguration, settings *FsConfiguration) *HttpCache {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_HTTP_TIMEOUT
+	}
+
+	return &HttpCache{
+		remoteSettings: newRemoteSettings(settings),
+		cfg:            cfg,
+		client:         &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}
+}
+
+func (c *HttpCache) newRequest(ctx context.Context, method string, digest []byte, body []byte) (*http.Request, error) {
+	url := strings.TrimSuffix(c.cfg.Url, "/") + "/" + c.namespacePrefix("/") + hex.EncodeToString(digest)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(c.cfg.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+
+	return req, nil
+}
+
+// Any response of the server is an answer, whatever its status.
+func (c *HttpCache) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.cfg.Url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Whether the request may succeed when it is sent again, i.e. when the server
+// is overloaded or failing.
+func isRetriableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Send the request, retrying transport errors and retriable statuses. The
+// response is returned along with its body, which has been read completely.
+func (c *HttpCache) send(ctx context.Context, method string, digest []byte, body []byte) (*http.Response, []byte, error) {
+	var resp *http.Response
+	var content []byte
+	err := c.withRetries(ctx, func() error {
+		req, err := c.newRequest(ctx, method, digest, body)
+		if err != nil {
+			return err
+		}
+
+		resp, err = c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if isRetriableStatus(resp.StatusCode) {
+			return fmt.Errorf("%v", resp.Status)
+		}
+		content, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return resp, content, err
+}
+
+// Errors talking to the server are retried, then reported as
+// `ErrBackendUnavailable`, as are unexpected responses.
+func (c *HttpCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	resp, content, err := c.send(ctx, http.MethodGet, digest, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: HTTP: %v", ErrBackendUnavailable, err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%w: HTTP: %v", ErrBackendUnavailable, resp.Status)
+	}
+
+	return content, true, nil
+}
+
+func (c *HttpCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	resp, _, err := c.send(ctx, http.MethodPut, digest, content)
+	if err != nil {
+		return fmt.Errorf("%w: HTTP: %v", ErrBackendUnavailable, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%w: HTTP: %v", ErrBackendUnavailable, resp.Status)
+	}
+
+	return nil
+}
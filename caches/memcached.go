@@ -0,0 +1,100 @@
+package caches
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+const MEMCACHED_KEY_PREFIX = "ctcache:"
+
+// Limits of memcached on the length of keys and the size of items
+const MEMCACHED_MAX_KEY_LENGTH = 250
+const MEMCACHED_MAX_ITEM_SIZE = 1024 * 1024
+
+type MemcachedConfiguration struct {
+	// Addresses of the servers, e.g. `localhost:11211`
+	Servers []string `json:"servers"`
+	// Expiry of the entries in seconds, zero means the entries never expire
+	TTL int `json:"ttl"`
+}
+
+type MemcachedCache struct {
+	remoteSettings
+	cfg    *MemcachedConfiguration
+	client *memcache.Client
+}
+
+func NewMemcachedCache(cfg *MemcachedConfiguration, settings *FsConfiguration) *MemcachedCache {
+	return &MemcachedCache{
+		remoteSettings: newRemoteSettings(settings),
+		cfg:            cfg,
+		client:         memcache.New(cfg.Servers...),
+	}
+}
+
+// Keys that are too long for memcached are replaced by their digest.
+func (r remoteSettings) defineMemcachedKey(digest []byte) string {
+	key := MEMCACHED_KEY_PREFIX + r.namespacePrefix(":") + hex.EncodeToString(digest)
+	if len(key) > MEMCACHED_MAX_KEY_LENGTH {
+		hashed := sha256.Sum256([]byte(key))
+		key = MEMCACHED_KEY_PREFIX + hex.EncodeToString(hashed[:])
+	}
+	return key
+}
+
+func (c *MemcachedCache) Ping(ctx context.Context) error {
+	return c.client.Ping()
+}
+
+// Connection problems are retried, then reported as `ErrBackendUnavailable`,
+// which the wrapper treats as a cache miss so that an unavailable memcached
+// server never breaks the build.
+func (c *MemcachedCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	var item *memcache.Item
+	err := c.withRetries(ctx, func() error {
+		var err error
+		item, err = c.client.Get(c.defineMemcachedKey(digest))
+		if err == memcache.ErrCacheMiss {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: memcached: %v", ErrBackendUnavailable, err)
+	}
+	if item == nil {
+		return nil, false, nil
+	}
+
+	return item.Value, true, nil
+}
+
+// Entries larger than the item size limit of memcached are not stored, so
+// they are a miss the next time.
+func (c *MemcachedCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key := c.defineMemcachedKey(digest)
+	if len(key)+len(content) > MEMCACHED_MAX_ITEM_SIZE {
+		utils.Debugf("Not storing %d bytes in memcached, which is over the item size limit", len(content))
+		return nil
+	}
+
+	item := &memcache.Item{Key: key, Value: content, Expiration: int32(c.cfg.TTL)}
+	if err := c.withRetries(ctx, func() error { return c.client.Set(item) }); err != nil {
+		return fmt.Errorf("%w: memcached: %v", ErrBackendUnavailable, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Largest total size of the hits a `MemoCache` keeps in memory
+const MEMO_MAX_SIZE = 64 * 1024 * 1024
+
+// Misses are remembered this long, since other clients may store the entry meanwhile
+const MEMO_MISS_TTL = time.Minute
+
+// MemoCache remembers the lookups of a remote cache for the lifetime of the
+// process, so that repeated lookups of the same digest skip the network. The
+// content of hits is kept until MEMO_MAX_SIZE is reached, misses for
+// MEMO_MISS_TTL or until the entry is saved through the cache. This matters
+// for long running processes such as `clang-tidy-cache serve` and tools using
+// the package, a single run of clang-tidy only looks up its digest once.
+type MemoCache struct {
+	cache Cacher
+
+	mutex  sync.Mutex
+	hits   map[string][]byte
+	size   int64
+	misses map[string]time.Time
+}
+
+func NewMemoCache(cache Cacher) *MemoCache {
+	return &MemoCache{
+		cache:  cache,
+		hits:   map[string][]byte{},
+		misses: map[string]time.Time{},
+	}
+}
+
+// Check if the cache talks to a server, so that remembering its lookups saves round trips.
+func isNetworkCache(cache Cacher) bool {
+	switch cache.(type) {
+	case *RedisCache, *MemcachedCache, *S3Cache, *AzureBlobCache, *GoogleCloudStorageCache, *HttpCache:
+		return true
+	}
+	return false
+}
+
+// Look up the remembered outcome of a lookup, the boolean tells if there is one.
+func (c *MemoCache) recall(key string) ([]byte, bool, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if content, ok := c.hits[key]; ok {
+		return append([]byte(nil), content...), true, true
+	}
+	if missed, ok := c.misses[key]; ok {
+		if time.Since(missed) < MEMO_MISS_TTL {
+			return nil, false, true
+		}
+		delete(c.misses, key)
+	}
+	return nil, false, false
+}
+
+func (c *MemoCache) remember(key string, content []byte, found bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !found {
+		c.misses[key] = time.Now()
+		return
+	}
+	delete(c.misses, key)
+	if _, ok := c.hits[key]; ok || c.size+int64(len(content)) > MEMO_MAX_SIZE {
+		return
+	}
+	c.hits[key] = append([]byte(nil), content...)
+	c.size += int64(len(content))
+}
+
+func (c *MemoCache) Unwrap() Cacher {
+	return c.cache
+}
+
+// Errors are not remembered, so that the next lookup tries again.
+func (c *MemoCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	key := hex.EncodeToString(digest)
+	if content, found, ok := c.recall(key); ok {
+		return content, found, nil
+	}
+
+	content, found, err := c.cache.FindEntry(ctx, digest)
+	if err != nil {
+		return nil, false, err
+	}
+	c.remember(key, content, found)
+	return content, found, nil
+}
+
+// Only a successful save is remembered as a hit, a failed one may not have stored the entry.
+func (c *MemoCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	key := hex.EncodeToString(digest)
+	c.forget(key)
+	if err := c.cache.SaveEntry(ctx, digest, content); err != nil {
+		return err
+	}
+	c.remember(key, content, true)
+	return nil
+}
+
+func (c *MemoCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	for key := range entries {
+		c.forget(key)
+	}
+	return SaveEntries(ctx, c.cache, entries)
+}
+
+// Forget the outcome of earlier lookups of the entry.
+func (c *MemoCache) forget(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.misses, key)
+	if content, ok := c.hits[key]; ok {
+		c.size -= int64(len(content))
+		delete(c.hits, key)
+	}
+}
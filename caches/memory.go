@@ -0,0 +1,73 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+)
+
+// InMemoryCache keeps the entries in a map for the lifetime of the process. It
+// is safe for concurrent use, which makes it suitable for `serve` and as a
+// cache in the tests of tools that embed this package.
+type InMemoryCache struct {
+	mutex   sync.RWMutex
+	entries map[string][]byte
+	size    int64
+}
+
+func NewInMemoryCache() *InMemoryCache {
+	return &InMemoryCache{entries: map[string][]byte{}}
+}
+
+// The content is copied, so that callers can not modify the stored entry.
+func (c *InMemoryCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	content, found := c.entries[hex.EncodeToString(digest)]
+	if !found {
+		return nil, false, nil
+	}
+	return append([]byte{}, content...), true, nil
+}
+
+func (c *InMemoryCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := hex.EncodeToString(digest)
+	c.size += int64(len(content)) - int64(len(c.entries[key]))
+	c.entries[key] = append([]byte{}, content...)
+	return nil
+}
+
+func (c *InMemoryCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	if _, err := decodeEntryKeys(entries); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, content := range entries {
+		c.size += int64(len(content)) - int64(len(c.entries[key]))
+		c.entries[key] = append([]byte{}, content...)
+	}
+	return nil
+}
+
+// Len returns the number of entries in the cache.
+func (c *InMemoryCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return len(c.entries)
+}
+
+// Size returns the total size of the content of the entries in bytes.
+func (c *InMemoryCache) Size() int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.size
+}
@@ -0,0 +1,41 @@
+package caches
+
+import (
+	"path/filepath"
+	"regexp"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Directory in the root of the filesystem cache that holds a cache for every namespace
+const NAMESPACES_DIR = "namespaces"
+
+// Namespaces end up in paths and keys, so only a safe set of characters is allowed
+var validNamespace = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// GetNamespace gets the namespace of the cache from `namespace` in the
+// configuration, or CLANG_TIDY_CACHE_NAMESPACE. The entries of a namespace are kept apart from those of other
+// namespaces, so that they can be pruned and cleared on their own. Empty means
+// that no namespace is used.
+func (cfg *FsConfiguration) GetNamespace() string {
+	namespace := cfg.Namespace
+	if len(namespace) > 0 && !validNamespace.MatchString(namespace) {
+		utils.Warnf("Invalid namespace %q, not using a namespace", namespace)
+		return ""
+	}
+	return namespace
+}
+
+// Prefix of the keys of remote caches for the namespace, ending in separator.
+func (r remoteSettings) namespacePrefix(separator string) string {
+	if len(r.namespace) > 0 {
+		return r.namespace + separator
+	}
+	return ""
+}
+
+// Check if the path is the directory with the namespaces in the root of the
+// cache, which is skipped when walking the cache itself.
+func isNamespacesDir(root string, path string) bool {
+	return filepath.Dir(path) == filepath.Clean(root) && filepath.Base(path) == NAMESPACES_DIR
+}
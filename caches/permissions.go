@@ -0,0 +1,64 @@
+package caches
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+const DEFAULT_DIR_MODE = 0755
+const DEFAULT_FILE_MODE = 0644
+
+// Parse an octal mode such as `0775` or `2775`, including the setuid, setgid
+// and sticky bits.
+func parseMode(value string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("Invalid mode %q", value)
+	}
+
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// Get the configured mode, or the default mode with the umask of the process
+// applied when it is not configured.
+func getMode(value string, defaultMode os.FileMode) os.FileMode {
+	if len(value) == 0 {
+		return defaultMode &^ utils.Umask()
+	}
+
+	mode, err := parseMode(value)
+	if err != nil {
+		utils.Warnf("%v, using the default of %#o", err, defaultMode)
+		return defaultMode &^ utils.Umask()
+	}
+	return mode
+}
+
+// GetDirMode gets the mode of the directories created in the cache. It defaults
+// to 0755 with the umask applied and can be overridden by setting `dir_mode`
+// in the configuration, or CLANG_TIDY_CACHE_DIR_MODE, e.g. to `2775` for a
+// cache shared by a group.
+func (cfg *FsConfiguration) GetDirMode() os.FileMode {
+	return getMode(cfg.DirMode, DEFAULT_DIR_MODE)
+}
+
+// GetFileMode gets the mode of the files created in the cache. It defaults to
+// 0644 with the umask applied and can be overridden by setting `file_mode` in
+// the configuration, or CLANG_TIDY_CACHE_FILE_MODE, e.g. to `0664` for a cache
+// shared by a group.
+func (cfg *FsConfiguration) GetFileMode() os.FileMode {
+	return getMode(cfg.FileMode, DEFAULT_FILE_MODE)
+}
@@ -0,0 +1,118 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Pin the entries of the filesystem cache of `SetFsConfiguration()` with the
+// given (hex encoded) digests, or unpin them. Pinned entries are kept by `Prune()` regardless of
+// when they were used and of the limits on the number of entries and the size
+// of the cache. The pin is stored in ENTRIES_FILE, so an entry that is still in
+// its own file is moved there. Returns the digests that are not in the cache.
+func Pin(ctx context.Context, digests []string, pinned bool) ([]string, error) {
+	for i, digest := range digests {
+		digests[i] = strings.ToLower(digest)
+		if !isEntryDigest(digests[i]) {
+			return nil, fmt.Errorf("Invalid digest %q", digest)
+		}
+	}
+
+	root := fsConfig.GetFileSystemCachePath()
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return digests, nil
+	}
+	root, err := resolveCacheRoot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fileMode := fsConfig.GetFileMode()
+	lock, err := lockEntries(root, true, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	entries, err := readJsonForRewrite(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	changed := []string{}
+	consolidated := []string{}
+	for _, digest := range digests {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		entry, exists := entries[digest]
+		paths, err := entryFilePaths(root, digest, fsConfig.GetShardDepth())
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			_, fileEntry, err := readEntryFile(root, entryFile{path: path, info: info}, fsConfig.GetCompression())
+			if err != nil {
+				return nil, err
+			}
+			if !exists || fileEntry.LastUsed.After(entry.LastUsed) {
+				entry, exists = fileEntry, true
+			}
+			consolidated = append(consolidated, path)
+		}
+		if !exists {
+			missing = append(missing, digest)
+			continue
+		}
+
+		entry.Pinned = pinned
+		entries[digest] = entry
+		changed = append(changed, digest)
+	}
+	if len(missing) == len(digests) {
+		return missing, nil
+	}
+
+	if err := updateJson(root, entries, changed, nil, fileMode, fsConfig.IsEntriesLog()); err != nil {
+		return nil, err
+	}
+	for _, path := range consolidated {
+		if err := removeCachePath(root, path); err != nil {
+			utils.Warnf("Error deleting file: %v", err)
+		}
+	}
+	return missing, nil
+}
+
+// Get the paths the entry file of the digest can have, with the layout of the
+// depth and the default layout used by earlier versions.
+func entryFilePaths(root string, digest string, depth int) ([]string, error) {
+	decoded, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, depth := range []int{DEFAULT_SHARD_DEPTH, depth} {
+		_, path, err := defineShardedPath(root, decoded, depth)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 || paths[0] != path {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,45 @@
+package caches
+
+import (
+	"context"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// IsReadOnly checks if the caches are only used for lookups, which is enabled
+// by setting `read_only` in the configuration, or CLANG_TIDY_CACHE_READONLY to
+// 1. Results are not saved then, and hits do
+// not update the last used time of the entries or the statistics, e.g. for
+// build agents that share a cache which a dedicated job fills.
+func (cfg *FsConfiguration) IsReadOnly() bool {
+	return cfg.ReadOnly
+}
+
+// ReadOnlyCache looks up the entries of a cache, saving entries is skipped.
+type ReadOnlyCache struct {
+	cache Cacher
+}
+
+func NewReadOnlyCache(cache Cacher) *ReadOnlyCache {
+	return &ReadOnlyCache{
+		cache: cache,
+	}
+}
+
+func (c *ReadOnlyCache) Unwrap() Cacher {
+	return c.cache
+}
+
+func (c *ReadOnlyCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	return c.cache.FindEntry(ctx, digest)
+}
+
+func (c *ReadOnlyCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	utils.Debugf("Not saving the cache entry %x, the cache is read-only", digest)
+	return nil
+}
+
+func (c *ReadOnlyCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	utils.Debugf("Not saving %d cache entries, the cache is read-only", len(entries))
+	return nil
+}
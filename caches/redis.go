@@ -0,0 +1,102 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const REDIS_KEY_PREFIX = "ctcache:"
+
+type RedisConfiguration struct {
+	Address string `json:"address"`
+	// Expiry of the entries in seconds, zero means the entries never expire
+	TTL int `json:"ttl"`
+}
+
+type RedisCache struct {
+	remoteSettings
+	cfg  *RedisConfiguration
+	pool *redis.Pool
+}
+
+func NewRedisCache(cfg *RedisConfiguration, settings *FsConfiguration) *RedisCache {
+	pool := &redis.Pool{
+		MaxIdle:     1,
+		IdleTimeout: 60 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", cfg.Address, redis.DialConnectTimeout(5*time.Second))
+		},
+	}
+
+	return &RedisCache{
+		remoteSettings: newRemoteSettings(settings),
+		cfg:            cfg,
+		pool:           pool,
+	}
+}
+
+func (r remoteSettings) defineRedisKey(digest []byte) string {
+	return REDIS_KEY_PREFIX + r.namespacePrefix(":") + hex.EncodeToString(digest)
+}
+
+// Run the command on a connection from the pool.
+func (c *RedisCache) do(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	return redis.DoContext(conn, ctx, command, args...)
+}
+
+// An error reply, e.g. when authentication is required, is an answer as well.
+func (c *RedisCache) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "PING")
+	if _, ok := err.(redis.Error); ok {
+		return nil
+	}
+	return err
+}
+
+// Connection problems are retried, then reported as `ErrBackendUnavailable`,
+// which the wrapper treats as a cache miss so that an unavailable Redis server
+// never breaks the build.
+func (c *RedisCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	var content []byte
+	found := false
+	err := c.withRetries(ctx, func() error {
+		var err error
+		content, err = redis.Bytes(c.do(ctx, "GET", c.defineRedisKey(digest)))
+		if err == redis.ErrNil {
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: Redis: %v", ErrBackendUnavailable, err)
+	}
+
+	return content, found, nil
+}
+
+func (c *RedisCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	args := redis.Args{}.Add(c.defineRedisKey(digest), content)
+	if c.cfg.TTL > 0 {
+		args = args.Add("EX", c.cfg.TTL)
+	}
+	err := c.withRetries(ctx, func() error {
+		_, err := c.do(ctx, "SET", args...)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: Redis: %v", ErrBackendUnavailable, err)
+	}
+
+	return nil
+}
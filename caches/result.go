@@ -0,0 +1,60 @@
+package caches
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+const RESULT_VERSION = 1
+
+// Result is the outcome of a clang-tidy invocation as it is stored in the cache.
+type Result struct {
+	Version  int    `json:"version"`
+	Stdout   []byte `json:"stdout,omitempty"`
+	Stderr   []byte `json:"stderr,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	// Contents of the `-export-fixes` file, if one was requested
+	Fixes []byte `json:"fixes,omitempty"`
+	// The hash algorithm of the fingerprint, empty for `utils.DEFAULT_HASH`
+	Hash string `json:"hash,omitempty"`
+	// Wall time of the clang-tidy run, which every hit on the entry saves
+	Duration time.Duration `json:"duration,omitempty"`
+	// The output has the colors of a run with `-use-color`, otherwise it has
+	// none, see `utils.StripAnsi()`
+	Colors bool `json:"colors,omitempty"`
+}
+
+// EncodeResult encodes the result as the content of a cache entry, tagged with
+// the current hash algorithm.
+func EncodeResult(result *Result) ([]byte, error) {
+	result.Version = RESULT_VERSION
+	result.Hash = ""
+	if algorithm := utils.HashAlgorithm(); algorithm != utils.DEFAULT_HASH {
+		result.Hash = algorithm
+	}
+	return json.Marshal(result)
+}
+
+// DecodeResult decodes the content of a cache entry. Older versions stored the
+// raw output of clang-tidy (or the exported fixes) instead of a `Result`, in
+// which case false is returned.
+func DecodeResult(content []byte) (*Result, bool) {
+	var result Result
+	if err := json.Unmarshal(content, &result); err != nil || result.Version == 0 {
+		return nil, false
+	}
+	return &result, true
+}
+
+// HasCurrentHash checks if the content of a cache entry was stored with the
+// current hash algorithm, so that entries of another algorithm are a miss
+// even if their digests collide. Untagged entries used `utils.DEFAULT_HASH`.
+func HasCurrentHash(content []byte) bool {
+	algorithm := utils.DEFAULT_HASH
+	if result, ok := DecodeResult(content); ok && len(result.Hash) > 0 {
+		algorithm = result.Hash
+	}
+	return algorithm == utils.HashAlgorithm()
+}
@@ -0,0 +1,89 @@
+package caches
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Number of times a failed operation on a remote cache is retried by default
+const DEFAULT_REMOTE_RETRIES = 2
+
+// Delay before the first retry, which doubles for every further retry up to REMOTE_RETRY_MAX_DELAY
+const REMOTE_RETRY_DELAY = 100 * time.Millisecond
+const REMOTE_RETRY_MAX_DELAY = 2 * time.Second
+
+// GetRemoteRetries gets the number of times a failed lookup or write on a
+// remote cache is retried from `remote_retries` in the configuration, or
+// CLANG_TIDY_CACHE_REMOTE_RETRIES. It defaults to 2, zero disables the
+// retries.
+func (cfg *FsConfiguration) GetRemoteRetries() (int, error) {
+	if cfg.RemoteRetries == nil {
+		return DEFAULT_REMOTE_RETRIES, nil
+	}
+	if *cfg.RemoteRetries < 0 {
+		return DEFAULT_REMOTE_RETRIES, fmt.Errorf("Invalid number of retries %d", *cfg.RemoteRetries)
+	}
+	return *cfg.RemoteRetries, nil
+}
+
+// The settings that the remote caches take from the FsConfiguration they are
+// created with.
+type remoteSettings struct {
+	namespace string
+	retries   int
+}
+
+func newRemoteSettings(settings *FsConfiguration) remoteSettings {
+	retries, err := settings.GetRemoteRetries()
+	if err != nil {
+		utils.Warnf("%v, using %d", err, retries)
+	}
+	return remoteSettings{namespace: settings.GetNamespace(), retries: retries}
+}
+
+// The random numbers, e.g. for the jitter, differ between processes, unlike
+// with the default source of earlier Go versions
+var (
+	randomMutex  sync.Mutex
+	randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Get a random duration between half and all of the delay.
+func jitter(delay time.Duration) time.Duration {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return delay/2 + time.Duration(randomSource.Int63n(int64(delay/2)+1))
+}
+
+// Run the operation on a remote cache until it succeeds, retrying up to
+// `GetRemoteRetries()` times with exponential backoff and jitter, so that
+// the clients of a throttled server do not retry in lockstep. The operation
+// returns nil for a miss, only errors are retried. The last error is
+// returned once the retries are exhausted or `ctx` is cancelled.
+func (r remoteSettings) withRetries(ctx context.Context, operation func() error) error {
+	delay := REMOTE_RETRY_DELAY
+	for attempt := 0; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= r.retries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := jitter(delay)
+		utils.Debugf("Retrying the remote cache in %v: %v", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay *= 2
+		if delay > REMOTE_RETRY_MAX_DELAY {
+			delay = REMOTE_RETRY_MAX_DELAY
+		}
+	}
+}
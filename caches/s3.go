@@ -0,0 +1,238 @@
+package caches
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+type S3Configuration struct {
+	Bucket string `json:"bucket"`
+	Region string `json:"region"`
+	// Optional endpoint override, e.g. for MinIO or localstack
+	Endpoint string `json:"endpoint"`
+}
+
+type S3Cache struct {
+	remoteSettings
+	cfg    *S3Configuration
+	client *s3.S3
+}
+
+func NewS3Cache(cfg *S3Configuration, settings *FsConfiguration) (*S3Cache, error) {
+	awsCfg := aws.NewConfig()
+	if len(cfg.Region) > 0 {
+		awsCfg = awsCfg.WithRegion(cfg.Region)
+	}
+	if len(cfg.Endpoint) > 0 {
+		// S3 compatible servers generally do not support virtual hosted buckets
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint).WithS3ForcePathStyle(true)
+	}
+
+	// the session picks up the credentials from the default AWS credential chain
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsCfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &S3Cache{
+		remoteSettings: newRemoteSettings(settings),
+		cfg:            cfg,
+		client:         s3.New(sess),
+	}
+
+	return cache, nil
+}
+
+// Object keys use the layout of the filesystem cache, always with slashes
+// regardless of the platform, in a directory per namespace.
+func (r remoteSettings) defineObjectKey(digest []byte) (string, error) {
+	_, key, err := defineEntryPath("", digest)
+	if err != nil {
+		return "", err
+	}
+	return r.namespacePrefix("/") + filepath.ToSlash(key), nil
+}
+
+// Any response of the server is an answer, e.g. when the credentials only
+// allow access to the objects.
+func (c *S3Cache) Ping(ctx context.Context) error {
+	_, err := c.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.cfg.Bucket)})
+	if _, ok := err.(awserr.RequestFailure); ok {
+		return nil
+	}
+	return err
+}
+
+// Network errors are retried, then reported as `ErrBackendUnavailable`.
+func (c *S3Cache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	key, err := c.defineObjectKey(digest)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var content []byte
+	found := false
+	err = c.withRetries(ctx, func() error {
+		output, err := c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(c.cfg.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				return nil
+			}
+			return err
+		}
+		defer output.Body.Close()
+
+		content, err = ioutil.ReadAll(output.Body)
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: S3: %v", ErrBackendUnavailable, err)
+	}
+
+	return content, found, nil
+}
+
+// Refresh the `LastModified` time of the objects so that it can be used in the
+// same way as `LastUsed` for the filesystem cache, e.g. by lifecycle rules.
+func (c *S3Cache) TouchEntries(ctx context.Context, digests [][]byte) error {
+	for _, digest := range digests {
+		key, err := c.defineObjectKey(digest)
+		if err != nil {
+			return err
+		}
+
+		// copy the object onto itself to update the last modified time
+		_, err = c.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:            aws.String(c.cfg.Bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(c.cfg.Bucket + "/" + key),
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		})
+		if err != nil {
+			// entries that were removed in the meantime do not need a touch
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *S3Cache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	key, err := c.defineObjectKey(digest)
+	if err != nil {
+		return err
+	}
+
+	err = c.withRetries(ctx, func() error {
+		_, err := c.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(c.cfg.Bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(content),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: S3: %v", ErrBackendUnavailable, err)
+	}
+
+	return nil
+}
+
+// PruneS3 removes the objects of the bucket whose `LastModified` time, which
+// hits refresh, is older than `maxAge`. Only the objects of the namespace of
+// the settings with the key of an entry are considered. With `dryRun` the
+// objects that would be removed are only counted.
+func PruneS3(ctx context.Context, cfg *S3Configuration, settings *FsConfiguration, maxAge time.Duration, dryRun bool) error {
+	if cfg == nil || len(cfg.Bucket) == 0 {
+		return fmt.Errorf("No S3 bucket configured")
+	}
+	cache, err := NewS3Cache(cfg, settings)
+	if err != nil {
+		return err
+	}
+
+	prefix := cache.namespacePrefix("/")
+	location := "s3://" + cfg.Bucket + "/" + prefix
+	now := time.Now()
+	found := 0
+	outdated := []*s3.ObjectIdentifier{}
+	err = cache.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(cfg.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			// the objects of other namespaces are in directories of their own
+			digest := strings.ReplaceAll(strings.TrimPrefix(aws.StringValue(object.Key), prefix), "/", "")
+			if !isEntryDigest(digest) {
+				continue
+			}
+			found++
+			if now.Sub(aws.TimeValue(object.LastModified)) > maxAge {
+				outdated = append(outdated, &s3.ObjectIdentifier{Key: object.Key})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Found", found, "cache entries in", location)
+	if len(outdated) == 0 {
+		fmt.Println("No outdated entries")
+		return nil
+	}
+	if dryRun {
+		fmt.Println("Would remove", len(outdated), "outdated cache entries")
+		return nil
+	}
+
+	// a request deletes at most 1000 objects
+	removed := 0
+	for start := 0; start < len(outdated); start += 1000 {
+		end := start + 1000
+		if end > len(outdated) {
+			end = len(outdated)
+		}
+		var output *s3.DeleteObjectsOutput
+		err := cache.withRetries(ctx, func() error {
+			var err error
+			output, err = cache.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(cfg.Bucket),
+				Delete: &s3.Delete{Objects: outdated[start:end], Quiet: aws.Bool(true)},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, failure := range output.Errors {
+			utils.Warnf("Failed to remove %s: %s", aws.StringValue(failure.Key), aws.StringValue(failure.Message))
+		}
+		removed += end - start - len(output.Errors)
+	}
+	fmt.Println("Removed", removed, "outdated cache entries")
+
+	return nil
+}
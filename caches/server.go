@@ -0,0 +1,160 @@
+package caches
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Largest entry the server accepts, anything bigger is surely not a result of clang-tidy
+const MAX_SERVER_ENTRY_SIZE = 64 * 1024 * 1024
+
+// The usage of the filesystem cache is scanned at most this often for the metrics
+const SERVER_USAGE_INTERVAL = time.Minute
+
+// Server serves a cache over the HTTP API of `HttpCache`, along with metrics
+// in the Prometheus text format on `/metrics`.
+type Server struct {
+	// the counters come first to keep them aligned for the atomic operations
+	hits   int64
+	misses int64
+	stores int64
+
+	cache Cacher
+	token string
+
+	usageMutex sync.Mutex
+	usageTime  time.Time
+	usage      cacheUsage
+}
+
+// NewServer creates the server for the cache. When token is set, requests to
+// the entries need to send it as a bearer token, the metrics are public.
+func NewServer(cache Cacher, token string) *Server {
+	return &Server{
+		cache: cache,
+		token: token,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		s.serveMetrics(w, r)
+		return
+	}
+
+	// the digest is the last part of the path, so that the cache can be served under a prefix
+	digest, err := hex.DecodeString(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+	if err != nil || len(digest) != sha256.Size {
+		http.NotFound(w, r)
+		return
+	}
+	if len(s.token) > 0 && r.Header.Get("Authorization") != "Bearer "+s.token {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		content, found, err := s.cache.FindEntry(r.Context(), digest)
+		// a corrupt entry is a miss, so that the client stores it again
+		if errors.Is(err, ErrCorrupt) {
+			utils.Warnf("Ignoring corrupt cache entry: %v", err)
+		} else if err != nil {
+			utils.Warnf("Error reading cache entry: %v", err)
+			writeError(w, err)
+			return
+		}
+		if !found {
+			atomic.AddInt64(&s.misses, 1)
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt64(&s.hits, 1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(content)
+	case http.MethodPut:
+		content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_SERVER_ENTRY_SIZE))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.cache.SaveEntry(r.Context(), digest, content); err != nil {
+			utils.Warnf("Error writing cache entry: %v", err)
+			writeError(w, err)
+			return
+		}
+		atomic.AddInt64(&s.stores, 1)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Respond with the status for the error, an unavailable backend is 503 so that
+// the clients retry.
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrBackendUnavailable) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "ctcache_hits_total", "counter", "Number of lookups that found an entry.", atomic.LoadInt64(&s.hits))
+	writeMetric(w, "ctcache_misses_total", "counter", "Number of lookups that found no entry.", atomic.LoadInt64(&s.misses))
+	writeMetric(w, "ctcache_stores_total", "counter", "Number of entries stored.", atomic.LoadInt64(&s.stores))
+
+	// the number and size of the entries are only known for the filesystem and in-memory caches, also when they
+	// are wrapped, e.g. to save only a sample of the entries
+	cache := Unwrap(s.cache)
+	if memCache, ok := cache.(*InMemoryCache); ok {
+		writeMetric(w, "ctcache_entries", "gauge", "Number of entries in the cache.", int64(memCache.Len()))
+		writeMetric(w, "ctcache_stored_bytes", "gauge", "Size of the entries in the cache in bytes.", memCache.Size())
+		return
+	}
+	fsCache, ok := cache.(*FileSystemCache)
+	if !ok {
+		return
+	}
+	usage, err := s.scanUsage(fsCache.root)
+	if err != nil {
+		utils.Warnf("Error scanning the cache: %v", err)
+		return
+	}
+	writeMetric(w, "ctcache_entries", "gauge", "Number of entries in the cache.", int64(len(usage.lastUsed)))
+	writeMetric(w, "ctcache_stored_bytes", "gauge", "Size of the cache on disk in bytes.", usage.totalSize)
+}
+
+// Scan the cache, or reuse the last scan when it is recent enough.
+func (s *Server) scanUsage(root string) (cacheUsage, error) {
+	s.usageMutex.Lock()
+	defer s.usageMutex.Unlock()
+
+	if time.Since(s.usageTime) < SERVER_USAGE_INTERVAL {
+		return s.usage, nil
+	}
+
+	usage, err := scanCache(root)
+	if err != nil {
+		return usage, err
+	}
+	s.usage, s.usageTime = usage, time.Now()
+	return usage, nil
+}
+
+func writeMetric(w http.ResponseWriter, name string, kind string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,38 @@
+package caches
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestServeMetricsOfWrappedCache(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("content")
+	if err := NewFsCache(&FsConfiguration{CacheDir: root}).SaveEntry(context.Background(), testDigest("content"), content); err != nil {
+		t.Fatal(err)
+	}
+
+	// the wrappers of the read-only cache, the store rate and the tracing all hide the filesystem cache
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	storeRate := 0.5
+	cache, _ := New(&Configuration{
+		Backend:         "fs",
+		FsConfiguration: FsConfiguration{CacheDir: root, ReadOnly: true, StoreRate: &storeRate},
+	})
+	if _, ok := cache.(Wrapper); !ok {
+		t.Fatalf("expected a wrapped cache, got %T", cache)
+	}
+
+	recorder := httptest.NewRecorder()
+	NewServer(cache, "").ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := recorder.Body.String()
+	for _, gauge := range []string{"\nctcache_entries 1\n", "\nctcache_stored_bytes "} {
+		if !strings.Contains(metrics, gauge) {
+			t.Errorf("the metrics miss %q:\n%s", strings.TrimSpace(gauge), metrics)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package caches
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// GetMaxEntrySize gets the size above which results are not cached from
+// `max_entry_size` in the configuration, or CLANG_TIDY_CACHE_MAX_ENTRY_SIZE,
+// e.g. `10MB`. Zero means that there is no limit.
+func (cfg *FsConfiguration) GetMaxEntrySize() (int64, error) {
+	size := cfg.MaxEntrySize
+	if len(size) == 0 {
+		return 0, nil
+	}
+
+	maxSize, err := utils.ParseSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid maximum entry size %q", size)
+	}
+	return maxSize, nil
+}
+
+// SizeLimitedCache skips saving entries larger than a maximum size, so that
+// the output of a pathological translation unit does not bloat the cache.
+type SizeLimitedCache struct {
+	cache   Cacher
+	maxSize int64
+	warning sync.Once
+}
+
+// NewSizeLimitedCache wraps the cache when maxSize is positive, otherwise the
+// cache is returned as it is.
+func NewSizeLimitedCache(cache Cacher, maxSize int64) Cacher {
+	if maxSize <= 0 {
+		return cache
+	}
+
+	return &SizeLimitedCache{
+		cache:   cache,
+		maxSize: maxSize,
+	}
+}
+
+func (c *SizeLimitedCache) Unwrap() Cacher {
+	return c.cache
+}
+
+func (c *SizeLimitedCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	return c.cache.FindEntry(ctx, digest)
+}
+
+// Entries that are too large are logged once, later ones only at the debug level.
+func (c *SizeLimitedCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	if int64(len(content)) <= c.maxSize {
+		return c.cache.SaveEntry(ctx, digest, content)
+	}
+
+	warned := false
+	c.warning.Do(func() {
+		utils.Warnf("Not caching a result of %d bytes, the maximum entry size is %d bytes", len(content), c.maxSize)
+		warned = true
+	})
+	if !warned {
+		utils.Debugf("Not caching a result of %d bytes, the maximum entry size is %d bytes", len(content), c.maxSize)
+	}
+	return nil
+}
+
+// Entries that are too large are skipped, without a warning.
+func (c *SizeLimitedCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	limited := make(map[string][]byte, len(entries))
+	for key, content := range entries {
+		if int64(len(content)) <= c.maxSize {
+			limited[key] = content
+		} else {
+			utils.Debugf("Not caching %s of %d bytes, the maximum entry size is %d bytes", key, len(content), c.maxSize)
+		}
+	}
+	return SaveEntries(ctx, c.cache, limited)
+}
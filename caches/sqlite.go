@@ -0,0 +1,29 @@
+package caches
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Default name of the SQLite database, in the directory of the filesystem cache
+const SQLITE_FILE = "entries.sqlite"
+
+// How long to wait for other processes to release the database, in milliseconds
+const SQLITE_BUSY_TIMEOUT = 30000
+
+type SqliteConfiguration struct {
+	// Path of the database, defaults to `entries.sqlite` in the cache directory
+	Path string `json:"path"`
+}
+
+func getSqlitePath(cfg *SqliteConfiguration, settings *FsConfiguration) string {
+	if cfg != nil && len(cfg.Path) > 0 {
+		return cfg.Path
+	}
+	return filepath.Join(settings.GetFileSystemCachePath(), SQLITE_FILE)
+}
+
+// Check if the file is the SQLite database or one of its journal files.
+func isSqliteFile(name string) bool {
+	return name == SQLITE_FILE || strings.HasPrefix(name, SQLITE_FILE+"-")
+}
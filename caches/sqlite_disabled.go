@@ -0,0 +1,36 @@
+//go:build !sqlite
+// +build !sqlite
+
+package caches
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var errSqliteDisabled = fmt.Errorf("Built without SQLite support, rebuild with `-tags sqlite`")
+
+// SqliteCache is only available when built with the `sqlite` tag, since the
+// driver requires cgo.
+type SqliteCache struct{}
+
+func NewSqliteCache(cfg *SqliteConfiguration, settings *FsConfiguration) (*SqliteCache, error) {
+	return nil, errSqliteDisabled
+}
+
+func (c *SqliteCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	return nil, false, errSqliteDisabled
+}
+
+func (c *SqliteCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	return errSqliteDisabled
+}
+
+func (c *SqliteCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	return errSqliteDisabled
+}
+
+func PruneSqlite(ctx context.Context, cfg *SqliteConfiguration, settings *FsConfiguration, maxAge time.Duration, dryRun bool) error {
+	return errSqliteDisabled
+}
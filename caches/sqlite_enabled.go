@@ -0,0 +1,221 @@
+//go:build sqlite
+// +build sqlite
+
+package caches
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS entries (
+	digest BLOB PRIMARY KEY,
+	content BLOB,
+	last_used INTEGER
+);
+CREATE INDEX IF NOT EXISTS entries_last_used ON entries (last_used);
+`
+
+// SqliteCache stores the entries in a SQLite database, which takes care of the
+// locking between processes. The content is compressed with the configured
+// codec and the last used time is in seconds since the epoch.
+type SqliteCache struct {
+	db          *sql.DB
+	compression string
+}
+
+func openSqliteDb(dbPath string, dirMode os.FileMode, fileMode os.FileMode) (*sql.DB, error) {
+	if err := utils.MkdirAllPerm(filepath.Dir(dbPath), dirMode); err != nil {
+		return nil, err
+	}
+
+	// the file is created with the configured mode rather than by SQLite
+	file, err := utils.OpenFilePerm(dbPath, os.O_RDWR, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=%d", dbPath, SQLITE_BUSY_TIMEOUT))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func NewSqliteCache(cfg *SqliteConfiguration, settings *FsConfiguration) (*SqliteCache, error) {
+	db, err := openSqliteDb(getSqlitePath(cfg, settings), settings.GetDirMode(), settings.GetFileMode())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteCache{db: db, compression: settings.GetCompression()}, nil
+}
+
+// A hit updates the last used time of the entry. A corrupt entry is reported
+// as `ErrCorrupt`.
+func (c *SqliteCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	var data []byte
+	err := c.db.QueryRowContext(ctx, "SELECT content FROM entries WHERE digest = ?", digest).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	content, err := decompress(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
+	_, err = c.db.ExecContext(ctx, "UPDATE entries SET last_used = ? WHERE digest = ?", time.Now().Unix(), digest)
+	if err != nil {
+		utils.Warnf("Error updating SQLite cache entry: %v", err)
+	}
+
+	return content, true, nil
+}
+
+func (c *SqliteCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	data, err := compress(content, c.compression)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.ExecContext(ctx, "INSERT OR REPLACE INTO entries (digest, content, last_used) VALUES (?, ?, ?)",
+		digest, data, time.Now().Unix())
+	return err
+}
+
+// SaveEntries stores the entries in a single transaction.
+func (c *SqliteCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	digests, err := decodeEntryKeys(entries)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO entries (digest, content, last_used) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, digest := range digests {
+		data, err := compress(entries[hex.EncodeToString(digest)], c.compression)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, digest, data, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Prune the SQLite cache in a single transaction, with the same limits as
+// `Prune()`. With `dryRun` the transaction is rolled back after reporting what
+// would be removed.
+func PruneSqlite(ctx context.Context, cfg *SqliteConfiguration, settings *FsConfiguration, maxAge time.Duration, dryRun bool) error {
+	maxEntries, err := settings.GetMaxCacheEntries()
+	if err != nil {
+		return err
+	}
+	maxSize, err := settings.GetMaxCacheSize()
+	if err != nil {
+		return err
+	}
+
+	dbPath := getSqlitePath(cfg, settings)
+	db, err := openSqliteDb(dbPath, settings.GetDirMode(), settings.GetFileMode())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var numEntries int64
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries").Scan(&numEntries); err != nil {
+		return err
+	}
+	fmt.Println("Found", numEntries, "cache entries in", dbPath)
+
+	removed := "Removed"
+	if dryRun {
+		removed = "Would remove"
+	}
+	deleteEntries := func(query string, args ...interface{}) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	// Keep only the most recent entries
+	cutoff := time.Now().Add(-maxAge).Unix()
+	diff, err := deleteEntries("DELETE FROM entries WHERE last_used < ?", cutoff)
+	if err != nil {
+		return err
+	}
+	if diff == 0 {
+		fmt.Println("No outdated entries")
+	} else {
+		fmt.Println(removed, diff, "outdated cache entries")
+	}
+
+	// Keep only the most recently used entries up to the maximum number
+	if maxEntries > 0 {
+		diff, err := deleteEntries(`DELETE FROM entries WHERE digest NOT IN
+			(SELECT digest FROM entries ORDER BY last_used DESC LIMIT ?)`, maxEntries)
+		if err != nil {
+			return err
+		}
+		if diff > 0 {
+			fmt.Println(removed, diff, "least recently used cache entries to keep", maxEntries, "entries")
+		}
+	}
+
+	// Keep only the most recently used entries that fit in the size budget
+	if maxSize > 0 {
+		diff, err := deleteEntries(`DELETE FROM entries WHERE digest IN
+			(SELECT digest FROM (SELECT digest, SUM(LENGTH(content)) OVER (ORDER BY last_used DESC, digest) AS total FROM entries)
+			WHERE total > ?)`, maxSize)
+		if err != nil {
+			return err
+		}
+		if diff > 0 {
+			fmt.Println(removed, diff, "least recently used cache entries to fit in", maxSize, "bytes")
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+	return tx.Commit()
+}
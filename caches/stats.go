@@ -0,0 +1,245 @@
+package caches
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+const STATS_FILE = "stats.json"
+
+// Advisory lock guarding STATS_FILE, separate from LOCK_FILE so that lookups
+// are not held up by a running prune
+const STATS_LOCK_FILE = "stats.lock"
+
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Total run time of clang-tidy of the hits, missing for entries of older versions
+	TimeSaved time.Duration `json:"time_saved,omitempty"`
+	// Hits of which the result differed from a fresh run, see `RecordCollision()`
+	Collisions int64 `json:"collisions,omitempty"`
+}
+
+func readStats(statsPath string) Stats {
+	stats := Stats{}
+	jsonData, err := ioutil.ReadFile(statsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.Warnf("Error reading cache stats: %v", err)
+		}
+		return stats
+	}
+
+	if err := json.Unmarshal(jsonData, &stats); err != nil {
+		utils.Warnf("Error decoding cache stats: %v", err)
+	}
+	return stats
+}
+
+// Get the run time of clang-tidy that a hit on the entry saves.
+func savedDuration(content []byte) time.Duration {
+	if result, ok := DecodeResult(content); ok {
+		return result.Duration
+	}
+	return 0
+}
+
+// Count a cache lookup in the stats, crediting the time saved by a hit.
+// Errors are logged since the stats should never get in the way of running
+// clang-tidy.
+func recordLookup(root string, dirMode os.FileMode, fileMode os.FileMode, hit bool, saved time.Duration) {
+	updateStats(root, dirMode, fileMode, func(stats *Stats) {
+		if hit {
+			stats.Hits++
+			stats.TimeSaved += saved
+		} else {
+			stats.Misses++
+		}
+	})
+}
+
+// Change the stats in the cache directory while holding STATS_LOCK_FILE. The
+// callers skip this for a read-only cache.
+func updateStats(root string, dirMode os.FileMode, fileMode os.FileMode, update func(stats *Stats)) {
+	if err := utils.MkdirAllPerm(root, dirMode); err != nil {
+		utils.Warnf("Error updating cache stats: %v", err)
+		return
+	}
+
+	lock, err := utils.LockFile(filepath.Join(root, STATS_LOCK_FILE), fileMode, true)
+	if err != nil {
+		utils.Warnf("Error locking cache stats: %v", err)
+		return
+	}
+	defer lock.Unlock()
+
+	statsPath := filepath.Join(root, STATS_FILE)
+	stats := readStats(statsPath)
+	update(&stats)
+
+	jsonData, err := json.Marshal(stats)
+	if err == nil {
+		err = utils.WriteFileAtomic(statsPath, jsonData, fileMode)
+	}
+	if err != nil {
+		utils.Warnf("Error updating cache stats: %v", err)
+	}
+}
+
+// Fraction of the inodes of the volume in use above which `PrintInfo()`
+// recommends to prune the cache
+const INODE_USAGE_WARNING = 0.9
+
+// Usage of the filesystem cache as found on disk
+type cacheUsage struct {
+	// Last used time of each entry by digest
+	lastUsed  map[string]time.Time
+	totalSize int64
+	// Digests of the pinned entries, which are only ever in the JSON
+	pinned []string
+	// Number of files and directories, each of which takes an inode
+	files int
+	dirs  int
+	// Number of entries that are in their own file rather than in the JSON
+	entryFiles int
+}
+
+// Scan the filesystem cache without modifying it. Entries are either
+// consolidated in the JSON or still in their own file, in which case the
+// modification time of the file is the last used time.
+func scanCache(root string) (cacheUsage, error) {
+	usage := cacheUsage{lastUsed: map[string]time.Time{}}
+	root, err := resolveCacheRoot(root)
+	if err != nil {
+		return usage, err
+	}
+	entries, err := readJson(filepath.Join(root, ENTRIES_FILE))
+	if err != nil {
+		return usage, err
+	}
+	for digest, entry := range entries {
+		usage.lastUsed[digest] = entry.LastUsed
+		if entry.Pinned {
+			usage.pinned = append(usage.pinned, digest)
+		}
+	}
+	sort.Strings(usage.pinned)
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && isNamespacesDir(root, path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			usage.dirs++
+			return nil
+		}
+		usage.files++
+		if isSymlink(info) {
+			return nil
+		}
+		usage.totalSize += info.Size()
+		if isCacheMetadata(root, path) || strings.HasSuffix(info.Name(), utils.TEMP_SUFFIX) {
+			return nil
+		}
+		digest := digestFromEntryPath(root, path)
+		if !isEntryDigest(digest) {
+			return nil
+		}
+
+		// a file is more recent than its consolidated entry, if there is one
+		usage.lastUsed[digest] = info.ModTime()
+		usage.entryFiles++
+		return nil
+	})
+	return usage, err
+}
+
+// Print the hit and miss counters and the time saved by the hits, along with
+// the number of entries and the size of the filesystem cache.
+func PrintStats() error {
+	root := fsConfig.GetFileSystemCachePath()
+	stats := readStats(filepath.Join(root, STATS_FILE))
+
+	usage, err := scanCache(root)
+	if err != nil {
+		return err
+	}
+
+	lookups := stats.Hits + stats.Misses
+	hitRate := 0.0
+	if lookups > 0 {
+		hitRate = 100 * float64(stats.Hits) / float64(lookups)
+	}
+
+	fmt.Println("Cache directory:", root)
+	fmt.Println("Hits:           ", stats.Hits)
+	fmt.Println("Misses:         ", stats.Misses)
+	fmt.Printf("Hit rate:        %.1f%%\n", hitRate)
+	fmt.Println("Entries:        ", len(usage.lastUsed))
+	fmt.Println("Size on disk:   ", usage.totalSize, "bytes")
+	fmt.Println("Time saved:     ", stats.TimeSaved)
+	if stats.Collisions > 0 {
+		fmt.Println("Collisions:     ", stats.Collisions)
+	}
+	return nil
+}
+
+// Print the number of entries, the size and the range of last used times of
+// the filesystem cache, followed by the pinned entries. The number of files is
+// printed along with the inode usage of the volume, since a cache of small
+// entries can run out of inodes long before it runs out of space. Unlike
+// `Prune()`, this leaves the cache untouched.
+func PrintInfo() error {
+	root := fsConfig.GetFileSystemCachePath()
+	usage, err := scanCache(root)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Cache directory:", root)
+	fmt.Println("Entries:        ", len(usage.lastUsed))
+	fmt.Println("Size on disk:   ", usage.totalSize, "bytes")
+	fmt.Println("Files:          ", usage.files, "in", usage.dirs, "directories,", usage.entryFiles, "of them entries")
+	if total, free, ok := utils.InodeUsage(root); ok {
+		used := float64(total-free) / float64(total)
+		fmt.Printf("Volume inodes:   %d of %d in use (%.1f%%)\n", total-free, total, 100*used)
+		if used >= INODE_USAGE_WARNING && usage.entryFiles > 0 {
+			utils.Warnf("The volume of the cache is running out of inodes, run `clang-tidy-cache prune` to move the %d entry files "+
+				"into %s, or lower CLANG_TIDY_CACHE_SHARD_DEPTH to use fewer directories", usage.entryFiles, ENTRIES_FILE)
+		}
+	}
+	if len(usage.lastUsed) == 0 {
+		return nil
+	}
+
+	var oldest, newest time.Time
+	for _, lastUsed := range usage.lastUsed {
+		if oldest.IsZero() || lastUsed.Before(oldest) {
+			oldest = lastUsed
+		}
+		if lastUsed.After(newest) {
+			newest = lastUsed
+		}
+	}
+	fmt.Println("Oldest entry:   ", oldest.Format(time.RFC3339))
+	fmt.Println("Newest entry:   ", newest.Format(time.RFC3339))
+	fmt.Println("Pinned entries: ", len(usage.pinned))
+	for _, digest := range usage.pinned {
+		fmt.Println("  ", digest, "last used", usage.lastUsed[digest].Format(time.RFC3339))
+	}
+	return nil
+}
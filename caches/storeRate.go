@@ -0,0 +1,73 @@
+package caches
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// GetStoreRate gets the fraction of the results that are saved from
+// `store_rate` in the configuration, or CLANG_TIDY_CACHE_STORE_RATE, from 0 to
+// 1, e.g. `0.1` to save one in ten results. It defaults to 1, so that every
+// result is saved.
+func (cfg *FsConfiguration) GetStoreRate() (float64, error) {
+	if cfg.StoreRate == nil {
+		return 1, nil
+	}
+	if *cfg.StoreRate < 0 || *cfg.StoreRate > 1 {
+		return 1, fmt.Errorf("Invalid store rate %g", *cfg.StoreRate)
+	}
+	return *cfg.StoreRate, nil
+}
+
+// SampledCache only saves a random fraction of the entries, e.g. for a large
+// build that will not be repeated, where saving every result costs more than
+// the hits it gives. All lookups still go to the cache. A result that is not
+// saved is a miss again the next time, and then has the same chance of being
+// saved, so results that keep missing end up in the cache eventually.
+type SampledCache struct {
+	cache Cacher
+	rate  float64
+}
+
+// NewSampledCache wraps the cache when the rate is below 1, otherwise the
+// cache is returned as it is.
+func NewSampledCache(cache Cacher, rate float64) Cacher {
+	if rate >= 1 {
+		return cache
+	}
+
+	return &SampledCache{
+		cache: cache,
+		rate:  rate,
+	}
+}
+
+func (c *SampledCache) Unwrap() Cacher {
+	return c.cache
+}
+
+func (c *SampledCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	return c.cache.FindEntry(ctx, digest)
+}
+
+// Check if the next entry should be saved.
+func (c *SampledCache) sample() bool {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return randomSource.Float64() < c.rate
+}
+
+func (c *SampledCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	if !c.sample() {
+		utils.Debugf("Not saving the cache entry %x, the store rate is %g", digest, c.rate)
+		return nil
+	}
+	return c.cache.SaveEntry(ctx, digest, content)
+}
+
+// Entries that are saved together, e.g. by an import, are all saved.
+func (c *SampledCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	return SaveEntries(ctx, c.cache, entries)
+}
@@ -0,0 +1,58 @@
+package caches
+
+import (
+	"context"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// TieredCache fronts a slower (e.g. remote) cache with a faster (e.g. local)
+// one. Both tiers can be tiered caches themselves.
+type TieredCache struct {
+	fast Cacher
+	slow Cacher
+}
+
+func NewTieredCache(fast Cacher, slow Cacher) *TieredCache {
+	return &TieredCache{
+		fast: fast,
+		slow: slow,
+	}
+}
+
+// Hits in the slow tier are copied into the fast tier for the next lookup.
+func (c *TieredCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	content, found, err := c.fast.FindEntry(ctx, digest)
+	if err != nil {
+		utils.Warnf("Error reading from the fast cache tier: %v", err)
+	}
+	if found {
+		return content, true, nil
+	}
+
+	content, found, err = c.slow.FindEntry(ctx, digest)
+	if err != nil || !found {
+		return content, found, err
+	}
+
+	if err := c.fast.SaveEntry(ctx, digest, content); err != nil {
+		utils.Warnf("Error writing to the fast cache tier: %v", err)
+	}
+	return content, true, nil
+}
+
+func (c *TieredCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	fastErr := c.fast.SaveEntry(ctx, digest, content)
+	if err := c.slow.SaveEntry(ctx, digest, content); err != nil {
+		return err
+	}
+	return fastErr
+}
+
+func (c *TieredCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	fastErr := SaveEntries(ctx, c.fast, entries)
+	if err := SaveEntries(ctx, c.slow, entries); err != nil {
+		return err
+	}
+	return fastErr
+}
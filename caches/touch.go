@@ -0,0 +1,209 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Digests of the remote entries that were hit since the last flush, one per line
+const TOUCH_FILE = "touches.log"
+
+// Advisory lock guarding TOUCH_FILE while it is flushed
+const TOUCH_LOCK_FILE = "touches.lock"
+
+// Empty file of which the modification time is the time of the last flush
+const TOUCH_TIME_FILE = "touches.time"
+
+// Toucher is implemented by caches that need to be told that entries are used
+// so that their last used time stays accurate for pruning, e.g. the object
+// stores that expire entries based on their modification time.
+type Toucher interface {
+	// Mark the cache entries specified by the digests as used now.
+	TouchEntries(ctx context.Context, digests [][]byte) error
+}
+
+// GetTouchInterval gets the interval at which hits on a remote cache are
+// passed on to it from `touch_interval` in the configuration, or
+// CLANG_TIDY_CACHE_TOUCH_INTERVAL, in the format of `time.ParseDuration()`.
+// Zero means that every hit touches the entry immediately.
+func (cfg *FsConfiguration) GetTouchInterval() (time.Duration, error) {
+	interval := cfg.TouchInterval
+	if len(interval) == 0 {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("Invalid touch interval %q", interval)
+	}
+	return duration, nil
+}
+
+// TouchingCache keeps the last used time of the entries of a Toucher up to
+// date. Instead of touching an entry on every hit, the hits can be collected
+// in the filesystem cache directory and flushed once per interval, so that a
+// lookup does not turn into a write on the remote.
+type TouchingCache struct {
+	cache    Cacher
+	toucher  Toucher
+	root     string
+	dirMode  os.FileMode
+	fileMode os.FileMode
+	interval time.Duration
+}
+
+// NewTouchingCache wraps the cache when it is a Toucher, other caches are
+// returned as they are. The hits are collected in the filesystem cache
+// directory of the settings, once per `GetTouchInterval()`.
+func NewTouchingCache(cache Cacher, settings *FsConfiguration) Cacher {
+	toucher, ok := cache.(Toucher)
+	if !ok {
+		return cache
+	}
+
+	interval, err := settings.GetTouchInterval()
+	if err != nil {
+		utils.Warnf("%v, touching entries on every hit", err)
+	}
+	return &TouchingCache{
+		cache:    cache,
+		toucher:  toucher,
+		root:     settings.GetFileSystemCachePath(),
+		dirMode:  settings.GetDirMode(),
+		fileMode: settings.GetFileMode(),
+		interval: interval,
+	}
+}
+
+func (c *TouchingCache) Unwrap() Cacher {
+	return c.cache
+}
+
+func (c *TouchingCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	content, found, err := c.cache.FindEntry(ctx, digest)
+	if err != nil || !found {
+		return content, found, err
+	}
+
+	if c.interval == 0 {
+		if err := c.toucher.TouchEntries(ctx, [][]byte{digest}); err != nil {
+			utils.Warnf("Error updating cache entry: %v", err)
+		}
+	} else {
+		c.recordTouch(digest)
+		c.flushTouches(ctx)
+	}
+
+	return content, found, nil
+}
+
+func (c *TouchingCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	return c.cache.SaveEntry(ctx, digest, content)
+}
+
+func (c *TouchingCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	return SaveEntries(ctx, c.cache, entries)
+}
+
+// Append the digest to TOUCH_FILE. A single line is written with one append,
+// so concurrent processes do not interleave their digests.
+func (c *TouchingCache) recordTouch(digest []byte) {
+	if err := utils.MkdirAllPerm(c.root, c.dirMode); err != nil {
+		utils.Warnf("Error recording cache hit: %v", err)
+		return
+	}
+
+	f, err := utils.OpenFilePerm(filepath.Join(c.root, TOUCH_FILE), os.O_WRONLY|os.O_APPEND, c.fileMode)
+	if err != nil {
+		utils.Warnf("Error recording cache hit: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte(hex.EncodeToString(digest) + "\n")); err != nil {
+		utils.Warnf("Error recording cache hit: %v", err)
+	}
+}
+
+// Touch the entries recorded in TOUCH_FILE once the interval has passed since
+// the last flush. The recorded hits are moved aside first, so hits of other
+// processes during the flush are kept for the next one.
+func (c *TouchingCache) flushTouches(ctx context.Context) {
+	timePath := filepath.Join(c.root, TOUCH_TIME_FILE)
+	if !c.shouldFlush(timePath) {
+		return
+	}
+
+	lock, err := utils.LockFile(filepath.Join(c.root, TOUCH_LOCK_FILE), c.fileMode, true)
+	if err != nil {
+		utils.Warnf("Error locking cache hits: %v", err)
+		return
+	}
+	defer lock.Unlock()
+
+	// another process may have flushed while we were waiting for the lock
+	if !c.shouldFlush(timePath) {
+		return
+	}
+
+	// a flush that failed before leaves its hits behind, those are retried first
+	touchPath := filepath.Join(c.root, TOUCH_FILE)
+	flushPath := touchPath + ".flush"
+	if _, err := os.Stat(flushPath); os.IsNotExist(err) {
+		if err := os.Rename(touchPath, flushPath); err != nil && !os.IsNotExist(err) {
+			utils.Warnf("Error flushing cache hits: %v", err)
+			return
+		}
+	}
+
+	data, err := ioutil.ReadFile(flushPath)
+	if err != nil && !os.IsNotExist(err) {
+		utils.Warnf("Error flushing cache hits: %v", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	var digests [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		// a torn line of an interrupted append is skipped, it would fail every flush
+		line = strings.TrimSpace(line)
+		if !isEntryDigest(line) || seen[line] {
+			continue
+		}
+		digest, _ := hex.DecodeString(line)
+		seen[line] = true
+		digests = append(digests, digest)
+	}
+
+	if len(digests) > 0 {
+		if err := c.toucher.TouchEntries(ctx, digests); err != nil {
+			utils.Warnf("Error updating cache entries: %v", err)
+			return
+		}
+	}
+	if err := os.Remove(flushPath); err != nil && !os.IsNotExist(err) {
+		utils.Warnf("Error flushing cache hits: %v", err)
+	}
+
+	if err := utils.WriteFileAtomic(timePath, nil, c.fileMode); err != nil {
+		utils.Warnf("Error flushing cache hits: %v", err)
+	}
+}
+
+func (c *TouchingCache) shouldFlush(timePath string) bool {
+	info, err := os.Stat(timePath)
+	return err != nil || time.Since(info.ModTime()) >= c.interval
+}
+
+// Check if the file belongs to the hits recorded for a TouchingCache.
+func isTouchFile(name string) bool {
+	return strings.HasPrefix(name, "touches.")
+}
@@ -0,0 +1,57 @@
+package caches
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// TracingCache records a span for every operation on a cache, with the digest,
+// whether it was a hit and the size of the content.
+type TracingCache struct {
+	cache Cacher
+}
+
+func NewTracingCache(cache Cacher) *TracingCache {
+	return &TracingCache{
+		cache: cache,
+	}
+}
+
+func (c *TracingCache) Unwrap() Cacher {
+	return c.cache
+}
+
+func (c *TracingCache) FindEntry(ctx context.Context, digest []byte) ([]byte, bool, error) {
+	ctx, span := utils.StartSpan(ctx, "FindEntry", attribute.String("cache.digest", hex.EncodeToString(digest)))
+	content, found, err := c.cache.FindEntry(ctx, digest)
+	span.SetAttributes(attribute.Bool("cache.hit", found), attribute.Int("cache.bytes", len(content)))
+	utils.EndSpan(span, err)
+	return content, found, err
+}
+
+func (c *TracingCache) SaveEntry(ctx context.Context, digest []byte, content []byte) error {
+	ctx, span := utils.StartSpan(ctx, "SaveEntry",
+		attribute.String("cache.digest", hex.EncodeToString(digest)),
+		attribute.Int("cache.bytes", len(content)),
+	)
+	err := c.cache.SaveEntry(ctx, digest, content)
+	utils.EndSpan(span, err)
+	return err
+}
+
+func (c *TracingCache) SaveEntries(ctx context.Context, entries map[string][]byte) error {
+	size := 0
+	for _, content := range entries {
+		size += len(content)
+	}
+	ctx, span := utils.StartSpan(ctx, "SaveEntries",
+		attribute.Int("cache.entries", len(entries)),
+		attribute.Int("cache.bytes", size),
+	)
+	err := SaveEntries(ctx, c.cache, entries)
+	utils.EndSpan(span, err)
+	return err
+}
@@ -0,0 +1,38 @@
+package caches
+
+import (
+	"bytes"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// CompareResults gets the parts of the fresh result that differ from the
+// cached one, empty when they are the same. The run time is not compared, and
+// neither are colors in the output, which older versions stored.
+func CompareResults(cached *Result, fresh *Result) []string {
+	differences := []string{}
+	if !bytes.Equal(utils.StripAnsi(cached.Stdout), utils.StripAnsi(fresh.Stdout)) {
+		differences = append(differences, "stdout")
+	}
+	if !bytes.Equal(utils.StripAnsi(cached.Stderr), utils.StripAnsi(fresh.Stderr)) {
+		differences = append(differences, "stderr")
+	}
+	if cached.ExitCode != fresh.ExitCode {
+		differences = append(differences, "exit code")
+	}
+	if !bytes.Equal(cached.Fixes, fresh.Fixes) {
+		differences = append(differences, "exported fixes")
+	}
+	return differences
+}
+
+// RecordCollision counts a collision found by verifying a hit in the stats of
+// the filesystem cache of `SetFsConfiguration()`.
+func RecordCollision() {
+	if fsConfig.IsReadOnly() {
+		return
+	}
+	updateStats(fsConfig.GetFileSystemCachePath(), fsConfig.GetDirMode(), fsConfig.GetFileMode(), func(stats *Stats) {
+		stats.Collisions++
+	})
+}
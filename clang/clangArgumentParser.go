@@ -2,13 +2,14 @@ package clang
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
 	"github.com/google/shlex"
 )
 
@@ -57,7 +58,49 @@ func ParseClangCommandString(commands string) (*CompilerCommand, error) {
 	return &cmd, nil
 }
 
-func EvaluatePreprocessedFile(buildRoot string, baseDir string, command *CompilerCommand) ([]byte, error) {
+// Flags that select the language standard, the standard library and the target,
+// with their value after a `=` or in the next argument
+var targetValueFlags = []string{"std", "stdlib", "target"}
+
+// Flags that select the data model of the target
+var targetModelFlags = map[string]bool{"-m16": true, "-m32": true, "-mx32": true, "-m64": true}
+
+// TargetFlags returns the flags of the command that select the language
+// standard, the standard library and the target, in the order of the command
+// and spelled as `-std=c++17` and `-target=<triple>` whichever form is used.
+// They change the diagnostics of clang-tidy without necessarily changing the
+// preprocessed source, e.g. `-std=c++17` and `-std=c++20` for a source that
+// does not test `__cplusplus`.
+func (c *CompilerCommand) TargetFlags() []string {
+	flags := []string{}
+	for i := 0; i < len(c.Arguments); i++ {
+		arg := c.Arguments[i]
+		if targetModelFlags[arg] || strings.HasPrefix(arg, "/std:") {
+			flags = append(flags, arg)
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		for _, flag := range targetValueFlags {
+			if strings.HasPrefix(name, flag+"=") {
+				flags = append(flags, "-"+name)
+			} else if name == flag && i+1 < len(c.Arguments) {
+				i++
+				flags = append(flags, "-"+flag+"="+c.Arguments[i])
+			}
+		}
+	}
+	return flags
+}
+
+// Compute the digest of the preprocessed output of the command with the named
+// hash algorithm. Occurrences of baseDir are replaced by a relative path, and
+// with ignoreWhitespace the output is normalized by `normalizeWhitespace()`
+// before hashing.
+func EvaluatePreprocessedFile(buildRoot string, baseDir string, ignoreWhitespace bool, command *CompilerCommand,
+	hashAlgorithm string) ([]byte, error) {
 	// make the temporary file
 	tmpfile, err := ioutil.TempFile("", "ctc-")
 	if err != nil {
@@ -87,23 +130,8 @@ func EvaluatePreprocessedFile(buildRoot string, baseDir string, command *Compile
 		return nil, err
 	}
 
-	// read the contents of the file am hash it
-	hasher := sha256.New()
-	if len(baseDir) == 0 {
-		f, err := os.Open(filename)
-		if err != nil {
-			return nil, err
-		}
-		defer func() {
-			f.Close()
-			// remove the file (clean up)
-			os.Remove(filename)
-		}()
-
-		if _, err := io.Copy(hasher, f); err != nil {
-			return nil, err
-		}
-	} else {
+	// the output is only read into memory when it has to be normalized
+	if len(baseDir) > 0 || ignoreWhitespace {
 		data, err := ioutil.ReadFile(filename)
 		if err != nil {
 			return nil, err
@@ -111,7 +139,23 @@ func EvaluatePreprocessedFile(buildRoot string, baseDir string, command *Compile
 		defer func() {
 			os.Remove(filename)
 		}()
-		hasher.Write(bytes.ReplaceAll(data, []byte(baseDir), []byte(".")))
+		return DigestPreprocessed(data, baseDir, ignoreWhitespace, hashAlgorithm), nil
+	}
+
+	// read the contents of the file am hash it
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.Close()
+		// remove the file (clean up)
+		os.Remove(filename)
+	}()
+
+	hasher := utils.NewHashOf(hashAlgorithm)
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, err
 	}
 
 	// compute the final digest
@@ -119,3 +163,37 @@ func EvaluatePreprocessedFile(buildRoot string, baseDir string, command *Compile
 
 	return digest, nil
 }
+
+// DigestPreprocessed computes the digest of preprocessed output in the same way
+// as `EvaluatePreprocessedFile()`, e.g. for output that was produced elsewhere.
+func DigestPreprocessed(data []byte, baseDir string, ignoreWhitespace bool, hashAlgorithm string) []byte {
+	if len(baseDir) > 0 {
+		data = bytes.ReplaceAll(data, []byte(baseDir), []byte("."))
+	}
+	if ignoreWhitespace {
+		data = normalizeWhitespace(data)
+	}
+	return utils.HashOf(hashAlgorithm, data)
+}
+
+// Strip the trailing whitespace (spaces, tabs and carriage returns) of every
+// line and collapse consecutive blank lines into a single one, so that
+// formatting changes that only shift lines do not change the digest.
+func normalizeWhitespace(data []byte) []byte {
+	normalized := make([]byte, 0, len(data))
+	blank := false
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimRight(line, " \t\r")
+		if len(line) == 0 {
+			if blank {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		normalized = append(normalized, line...)
+		normalized = append(normalized, '\n')
+	}
+	return normalized
+}
@@ -0,0 +1,35 @@
+package clang
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTargetFlags(t *testing.T) {
+	tests := []struct {
+		command string
+		flags   []string
+	}{
+		{"clang++ -O2 -Wall -o main.o -c main.cpp", []string{}},
+		{"clang++ -std=c++17 -o main.o -c main.cpp", []string{"-std=c++17"}},
+		{"clang++ --std=c++20 -o main.o -c main.cpp", []string{"-std=c++20"}},
+		{"clang++ --target=aarch64-linux-gnu -o main.o -c main.cpp", []string{"-target=aarch64-linux-gnu"}},
+		{"clang++ -target aarch64-linux-gnu -o main.o -c main.cpp", []string{"-target=aarch64-linux-gnu"}},
+		{"clang++ -stdlib=libc++ -o main.o -c main.cpp", []string{"-stdlib=libc++"}},
+		{"clang++ -m32 -o main.o -c main.cpp", []string{"-m32"}},
+		{"clang++ -m64 -o main.o -c main.cpp", []string{"-m64"}},
+		{
+			"clang++ -m32 -std=c++14 -I include -stdlib=libstdc++ -target i686-linux-gnu -o main.o -c main.cpp",
+			[]string{"-m32", "-std=c++14", "-stdlib=libstdc++", "-target=i686-linux-gnu"},
+		},
+	}
+	for _, test := range tests {
+		command, err := ParseClangCommandString(test.command)
+		if err != nil {
+			t.Fatalf("%s: %v", test.command, err)
+		}
+		if flags := command.TargetFlags(); !reflect.DeepEqual(flags, test.flags) {
+			t.Errorf("%s: got %q, want %q", test.command, flags, test.flags)
+		}
+	}
+}
@@ -17,12 +17,8 @@ type DatabaseEntry struct {
 
 type Database = []DatabaseEntry
 
-func ExtractCompilationTarget(databaseRootPath string, target string) (*DatabaseEntry, error) {
-	compilationDbPath, err := utils.FindInParents(databaseRootPath, "compile_commands.json")
-	if err != nil {
-		return nil, err
-	}
-
+// Read the compilation database at the path.
+func ReadDatabase(compilationDbPath string) (Database, error) {
 	jsonFile, err := os.Open(compilationDbPath)
 	if err != nil {
 		return nil, err
@@ -32,12 +28,28 @@ func ExtractCompilationTarget(databaseRootPath string, target string) (*Database
 	defer jsonFile.Close()
 
 	bytes, err := ioutil.ReadAll(jsonFile)
+	if err != nil {
+		return nil, err
+	}
 
 	var db Database
 	err = json.Unmarshal(bytes, &db)
 	if err != nil {
 		return nil, err
 	}
+	return db, nil
+}
+
+func ExtractCompilationTarget(databaseRootPath string, target string) (*DatabaseEntry, error) {
+	compilationDbPath, err := utils.FindInParents(databaseRootPath, "compile_commands.json")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := ReadDatabase(compilationDbPath)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, entry := range db {
 		if entry.File == target || entry.File == filepath.Join(entry.Directory, target) {
@@ -0,0 +1,58 @@
+package clang
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// Response files can include other response files, up to this depth
+const MAX_RESPONSE_FILE_DEPTH = 16
+
+// ExpandResponseFiles replaces every `@file` argument with the arguments in
+// the file, recursively. Relative paths are relative to wd, and arguments
+// naming a file that does not exist are kept as they are, like clang does.
+func ExpandResponseFiles(args []string, wd string) ([]string, error) {
+	return expandResponseFiles(args, wd, 0)
+}
+
+func expandResponseFiles(args []string, wd string, depth int) ([]string, error) {
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") || len(arg) == 1 {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		path := arg[1:]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(wd, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				expanded = append(expanded, arg)
+				continue
+			}
+			return nil, err
+		}
+		if depth >= MAX_RESPONSE_FILE_DEPTH {
+			return nil, fmt.Errorf("Response files nested too deeply in %s", path)
+		}
+
+		fileArgs, err := shlex.Split(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		fileArgs, err = expandResponseFiles(fileArgs, wd, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, fileArgs...)
+	}
+	return expanded, nil
+}
@@ -1,8 +1,10 @@
 package clang
 
 import (
+	"encoding/json"
 	"errors"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -10,6 +12,49 @@ type TidyInvocation struct {
 	ExportFile   *string
 	DatabaseRoot string
 	TargetPath   string
+	// Inline configuration passed with `-config`, overrides any configuration file
+	Config *string
+	// Configuration file passed with `-config-file`, overrides the `.clang-tidy` lookup
+	ConfigFile *string
+	// All of the other arguments, e.g. `-checks` in the form of `NormalizeChecks()`, which affect the result
+	Options []string
+	// Whether `-use-color` enables or disables colors, nil when it is not passed. It only changes the escape
+	// sequences in the output, so it is not one of the options.
+	UseColor *bool
+}
+
+// NormalizeChecks brings the globs of a `-checks` value into a canonical form,
+// so that equivalent values share a fingerprint. Whitespace and empty globs
+// are dropped. A check is enabled by the last glob that matches it, so the
+// order only matters between globs that enable and disable checks: each run of
+// consecutive globs of the same kind is sorted and deduplicated, while the
+// runs keep their order. For example `readability-*, -*,bugprone-*,cert-*`
+// becomes `readability-*,-*,bugprone-*,cert-*` and `cert-*,bugprone-*` becomes
+// `bugprone-*,cert-*`.
+func NormalizeChecks(checks string) string {
+	globs := []string{}
+	run := []string{}
+	flush := func() {
+		sort.Strings(run)
+		for i, glob := range run {
+			if i == 0 || glob != run[i-1] {
+				globs = append(globs, glob)
+			}
+		}
+		run = run[:0]
+	}
+	for _, glob := range strings.Split(checks, ",") {
+		glob = strings.TrimSpace(glob)
+		if len(glob) == 0 {
+			continue
+		}
+		if len(run) > 0 && strings.HasPrefix(run[0], "-") != strings.HasPrefix(glob, "-") {
+			flush()
+		}
+		run = append(run, glob)
+	}
+	flush()
+	return strings.Join(globs, ",")
 }
 
 // Extract value of CLI option at position int and return updated position.
@@ -37,6 +82,74 @@ func ExtractOption(args []string, position int, names []string, prefixes []strin
 	return position, nil
 }
 
+// NormalizeLineFilter brings the JSON value of `-line-filter` into a canonical
+// form, with sorted keys and without whitespace, so that equivalent filters
+// share a fingerprint. A value that is not valid JSON is kept as it is, for
+// clang-tidy to reject it.
+func NormalizeLineFilter(filter string) string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(filter), &value); err != nil {
+		return filter
+	}
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		return filter
+	}
+	return string(normalized)
+}
+
+// Boolean flags of clang-tidy that change its output, normalized by
+// `NormalizeBoolFlag()`
+var outputFlags = []string{"system-headers", "quiet"}
+
+// NormalizeBoolFlag brings a boolean flag of clang-tidy with the given name,
+// e.g. `quiet`, into a canonical form, so that its spellings share a
+// fingerprint: `-quiet`, `--quiet`, `-quiet=true` and `-quiet=1` become
+// `-quiet`, while `-quiet=false` and `-quiet=0` become the empty string, like
+// leaving the flag out. Returns false if the argument is not the flag.
+func NormalizeBoolFlag(arg string, name string) (string, bool) {
+	value, ok := ParseBoolFlag(arg, name)
+	if !ok {
+		return "", false
+	}
+	if value == nil {
+		// left as it is, for clang-tidy to reject it
+		return arg, true
+	}
+	if *value {
+		return "-" + name, true
+	}
+	return "", true
+}
+
+// ParseBoolFlag gets the value of a boolean flag of clang-tidy with the given
+// name in any of the spellings of `NormalizeBoolFlag()`, nil if the value is
+// not a boolean. Returns false if the argument is not the flag.
+func ParseBoolFlag(arg string, name string) (*bool, bool) {
+	value := "true"
+	option := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	if len(option) == len(arg) {
+		return nil, false
+	}
+	if index := strings.Index(option, "="); index >= 0 {
+		option, value = option[:index], option[index+1:]
+	}
+	if option != name {
+		return nil, false
+	}
+
+	var enabled bool
+	switch strings.ToLower(value) {
+	case "true", "1":
+		enabled = true
+	case "false", "0":
+		enabled = false
+	default:
+		return nil, true
+	}
+	return &enabled, true
+}
+
 func ParseTidyCommand(args []string) (*TidyInvocation, error) {
 	var invocation TidyInvocation
 	for i := 0; i < len(args); {
@@ -46,6 +159,67 @@ func ParseTidyCommand(args []string) (*TidyInvocation, error) {
 			continue
 		}
 
+		if pos, val := ExtractOption(args, i, []string{"-config", "--config"}, []string{"-config=", "--config="}); pos > i {
+			i = pos
+			invocation.Config = val
+			continue
+		}
+
+		if pos, val := ExtractOption(args, i, []string{"-config-file", "--config-file"}, []string{"-config-file=", "--config-file="}); pos > i {
+			i = pos
+			invocation.ConfigFile = val
+			continue
+		}
+
+		// both spellings of `-checks` share a fingerprint
+		if pos, val := ExtractOption(args, i, []string{"-checks", "--checks"}, []string{"-checks=", "--checks="}); pos > i {
+			i = pos
+			invocation.Options = append(invocation.Options, "-checks="+NormalizeChecks(*val))
+			continue
+		}
+
+		if pos, val := ExtractOption(args, i, []string{"-line-filter", "--line-filter"}, []string{"-line-filter=", "--line-filter="}); pos > i {
+			i = pos
+			invocation.Options = append(invocation.Options, "-line-filter="+NormalizeLineFilter(*val))
+			continue
+		}
+
+		// the header filters decide which diagnostics are shown, both spellings share a fingerprint
+		if pos, val := ExtractOption(args, i, []string{"-header-filter", "--header-filter"}, []string{"-header-filter=", "--header-filter="}); pos > i {
+			i = pos
+			invocation.Options = append(invocation.Options, "-header-filter="+*val)
+			continue
+		}
+
+		if pos, val := ExtractOption(args, i, []string{"-exclude-header-filter", "--exclude-header-filter"}, []string{"-exclude-header-filter=", "--exclude-header-filter="}); pos > i {
+			i = pos
+			invocation.Options = append(invocation.Options, "-exclude-header-filter="+*val)
+			continue
+		}
+
+		if useColor, ok := ParseBoolFlag(args[i], "use-color"); ok && useColor != nil && (i+1) < len(args) {
+			invocation.UseColor = useColor
+			i++
+			continue
+		}
+
+		if (i + 1) < len(args) {
+			matched := false
+			for _, name := range outputFlags {
+				if flag, ok := NormalizeBoolFlag(args[i], name); ok {
+					if len(flag) > 0 {
+						invocation.Options = append(invocation.Options, flag)
+					}
+					matched = true
+					break
+				}
+			}
+			if matched {
+				i++
+				continue
+			}
+		}
+
 		if pos, val := ExtractOption(args, i, []string{"-p"}, []string{"-p="}); pos > i {
 			i = pos
 			invocation.DatabaseRoot = *val
@@ -54,6 +228,8 @@ func ParseTidyCommand(args []string) (*TidyInvocation, error) {
 
 		if (i + 1) == len(args) {
 			invocation.TargetPath = args[i]
+		} else {
+			invocation.Options = append(invocation.Options, args[i])
 		}
 
 		i++
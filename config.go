@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/caches"
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+	"sigs.k8s.io/yaml"
+)
+
+const PROJECT_CONFIG_FILE = ".ctcache.yaml"
+
+type Configuration struct {
+	ClangTidyPath string `json:"clang_tidy_path"`
+	BaseDir       string `json:"base_dir"`
+	LogLevel      string `json:"log_level"`
+	// Normalize the whitespace of the preprocessed output before hashing it
+	IgnoreWhitespace bool `json:"ignore_whitespace"`
+	// Run clang-tidy without looking up or storing its results
+	Disable bool `json:"disable"`
+	// Algorithm of the digests of the fingerprint, `sha256` or `blake3`
+	Hash string `json:"hash"`
+	// Kill clang-tidy when it runs longer than this, e.g. `120s`
+	Timeout string `json:"timeout"`
+	// the parsed `Timeout`, zero without one
+	timeout time.Duration
+	// Keep the entries of the results from being pruned, from CLANG_TIDY_CACHE_PIN
+	Pin bool `json:"-"`
+	// Run clang-tidy on hits to check the cached results, from CLANG_TIDY_CACHE_VERIFY
+	Verify bool `json:"-"`
+	// the `backend`, `tiered` and backend specific keys along with those of the filesystem cache
+	caches.Configuration
+}
+
+func readConfigFile(cfg *Configuration) error {
+	// without a home directory there is no configuration file to read
+	home, err := utils.HomeDir()
+	if err != nil {
+		utils.Debugf("Skipping the configuration file: %v", err)
+		return nil
+	}
+
+	// define the configuration path
+	configPath := filepath.Join(home, ".ctcache", "config.json")
+
+	// missing config file is fine: we simply use the defaults or env vars
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	// open the configuration file
+	jsonFile, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+
+	// defer the closing of our jsonFile so that we can parse it later on
+	defer jsonFile.Close()
+
+	// read the contents
+	bytes, err := ioutil.ReadAll(jsonFile)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(bytes, cfg)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Read the configuration of the project from the first `.ctcache.yaml` in the working directory or its parents. The
+// keys are the same as in the JSON configuration file.
+func readProjectConfigFile(cfg *Configuration, wd string) error {
+	configPath, err := utils.FindInParents(wd, PROJECT_CONFIG_FILE)
+	if err != nil {
+		// missing config file is fine: we simply use the user configuration, defaults or env vars
+		return nil
+	}
+
+	bytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	err = yaml.Unmarshal(bytes, cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %v", configPath, err)
+	}
+
+	return nil
+}
+
+// Read an environment variable that holds a number, which is ignored with a
+// warning when it is not one.
+func readIntEnv(name string) (int, bool) {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return 0, false
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		utils.Warnf("Ignoring %s, %q is not a number", name, value)
+		return 0, false
+	}
+	return number, true
+}
+
+// Read the settings of the filesystem cache from the environment.
+func readFsConfigEnv(cfg *caches.FsConfiguration) {
+	if envDir := os.Getenv("CLANG_TIDY_CACHE_DIR"); len(envDir) > 0 {
+		cfg.CacheDir = envDir
+	}
+	if envCompression := os.Getenv("CLANG_TIDY_CACHE_COMPRESSION"); len(envCompression) > 0 {
+		cfg.Compression = envCompression
+	}
+	if envMaxSize := os.Getenv("CLANG_TIDY_CACHE_MAX_SIZE"); len(envMaxSize) > 0 {
+		cfg.Prune.MaxSize = envMaxSize
+	}
+	if envMaxAge := os.Getenv("CLANG_TIDY_CACHE_TTL"); len(envMaxAge) > 0 {
+		cfg.Prune.MaxAge = envMaxAge
+	}
+	if maxEntries, ok := readIntEnv("CLANG_TIDY_CACHE_MAX_ENTRIES"); ok {
+		cfg.Prune.MaxEntries = maxEntries
+	}
+	if minEntries, ok := readIntEnv("CLANG_TIDY_CACHE_PRUNE_MIN_ENTRIES"); ok {
+		cfg.Prune.MinEntries = &minEntries
+	}
+	if depth, ok := readIntEnv("CLANG_TIDY_CACHE_SHARD_DEPTH"); ok {
+		cfg.ShardDepth = &depth
+	}
+	if envNamespace := os.Getenv("CLANG_TIDY_CACHE_NAMESPACE"); len(envNamespace) > 0 {
+		cfg.Namespace = envNamespace
+	}
+	if envDirMode := os.Getenv("CLANG_TIDY_CACHE_DIR_MODE"); len(envDirMode) > 0 {
+		cfg.DirMode = envDirMode
+	}
+	if envFileMode := os.Getenv("CLANG_TIDY_CACHE_FILE_MODE"); len(envFileMode) > 0 {
+		cfg.FileMode = envFileMode
+	}
+	if envMaxEntrySize := os.Getenv("CLANG_TIDY_CACHE_MAX_ENTRY_SIZE"); len(envMaxEntrySize) > 0 {
+		cfg.MaxEntrySize = envMaxEntrySize
+	}
+	if envTouchInterval := os.Getenv("CLANG_TIDY_CACHE_TOUCH_INTERVAL"); len(envTouchInterval) > 0 {
+		cfg.TouchInterval = envTouchInterval
+	}
+	if envEntryTTL := os.Getenv("CLANG_TIDY_CACHE_ENTRY_TTL"); len(envEntryTTL) > 0 {
+		cfg.EntryTTL = envEntryTTL
+	}
+	if retries, ok := readIntEnv("CLANG_TIDY_CACHE_REMOTE_RETRIES"); ok {
+		cfg.RemoteRetries = &retries
+	}
+	if envRate := os.Getenv("CLANG_TIDY_CACHE_STORE_RATE"); len(envRate) > 0 {
+		if rate, err := strconv.ParseFloat(envRate, 64); err == nil {
+			cfg.StoreRate = &rate
+		} else {
+			utils.Warnf("Ignoring CLANG_TIDY_CACHE_STORE_RATE, %q is not a number", envRate)
+		}
+	}
+	if envReadOnly := os.Getenv("CLANG_TIDY_CACHE_READONLY"); len(envReadOnly) > 0 {
+		cfg.ReadOnly = envReadOnly == "1"
+	}
+	if envLog := os.Getenv("CLANG_TIDY_CACHE_ENTRIES_LOG"); len(envLog) > 0 {
+		cfg.EntriesLog = envLog == "1"
+	}
+	cfg.Audit = os.Getenv("CLANG_TIDY_CACHE_AUDIT") == "1"
+}
+
+func readConfigEnv(cfg *Configuration) {
+	if envPath := os.Getenv("CLANG_TIDY_CACHE_BINARY"); len(envPath) > 0 {
+		cfg.ClangTidyPath = envPath
+	}
+	// CLANG_TIDY_CACHE_PROJECT_ROOT is an alias, the more specific CLANG_TIDY_CACHE_BASEDIR wins
+	if envProjectRoot := os.Getenv("CLANG_TIDY_CACHE_PROJECT_ROOT"); len(envProjectRoot) > 0 {
+		cfg.BaseDir = filepath.Clean(envProjectRoot)
+	}
+	if envBaseDir := os.Getenv("CLANG_TIDY_CACHE_BASEDIR"); len(envBaseDir) > 0 {
+		cfg.BaseDir = filepath.Clean(envBaseDir)
+	}
+	if envLogLevel := os.Getenv("CLANG_TIDY_CACHE_LOG_LEVEL"); len(envLogLevel) > 0 {
+		cfg.LogLevel = envLogLevel
+	}
+	if envDisable := os.Getenv("CLANG_TIDY_CACHE_DISABLE"); len(envDisable) > 0 {
+		cfg.Disable = envDisable == "1"
+	}
+	if envIgnoreWhitespace := os.Getenv("CLANG_TIDY_CACHE_IGNORE_WHITESPACE"); len(envIgnoreWhitespace) > 0 {
+		cfg.IgnoreWhitespace = envIgnoreWhitespace == "1"
+	}
+	if envHash := os.Getenv("CLANG_TIDY_CACHE_HASH"); len(envHash) > 0 {
+		cfg.Hash = envHash
+	}
+	if envTimeout := os.Getenv("CLANG_TIDY_CACHE_TIMEOUT"); len(envTimeout) > 0 {
+		cfg.Timeout = envTimeout
+	}
+	cfg.Pin = os.Getenv("CLANG_TIDY_CACHE_PIN") == "1"
+	cfg.Verify = os.Getenv("CLANG_TIDY_CACHE_VERIFY") == "1"
+	readFsConfigEnv(&cfg.FsConfiguration)
+	if envBackend := os.Getenv("CLANG_TIDY_CACHE_BACKEND"); len(envBackend) > 0 {
+		cfg.Backend = envBackend
+	}
+	if envTiered := os.Getenv("CLANG_TIDY_CACHE_TIERED"); len(envTiered) > 0 {
+		cfg.Tiered = envTiered == "1"
+	}
+	if envGcsBucket := os.Getenv("CLANG_TIDY_CACHE_GCS_BUCKET"); len(envGcsBucket) > 0 {
+		if cfg.GcsConfig == nil {
+			cfg.GcsConfig = &caches.GcsConfiguration{}
+		}
+		cfg.GcsConfig.BucketId = envGcsBucket
+	}
+	if envGcsPrefix := os.Getenv("CLANG_TIDY_CACHE_GCS_PREFIX"); len(envGcsPrefix) > 0 && cfg.GcsConfig != nil {
+		cfg.GcsConfig.Prefix = envGcsPrefix
+	}
+	if envRedisAddr := os.Getenv("CLANG_TIDY_CACHE_REDIS_ADDR"); len(envRedisAddr) > 0 {
+		if cfg.RedisConfig == nil {
+			cfg.RedisConfig = &caches.RedisConfiguration{}
+		}
+		cfg.RedisConfig.Address = envRedisAddr
+	}
+	if envRedisTTL := os.Getenv("CLANG_TIDY_CACHE_REDIS_TTL"); len(envRedisTTL) > 0 {
+		if ttl, err := strconv.Atoi(envRedisTTL); err == nil && cfg.RedisConfig != nil {
+			cfg.RedisConfig.TTL = ttl
+		}
+	}
+	if envMemcachedServers := os.Getenv("CLANG_TIDY_CACHE_MEMCACHED_SERVERS"); len(envMemcachedServers) > 0 {
+		if cfg.MemcachedConfig == nil {
+			cfg.MemcachedConfig = &caches.MemcachedConfiguration{}
+		}
+		cfg.MemcachedConfig.Servers = strings.Split(envMemcachedServers, ",")
+	}
+	if envMemcachedTTL := os.Getenv("CLANG_TIDY_CACHE_MEMCACHED_TTL"); len(envMemcachedTTL) > 0 {
+		if ttl, err := strconv.Atoi(envMemcachedTTL); err == nil && cfg.MemcachedConfig != nil {
+			cfg.MemcachedConfig.TTL = ttl
+		}
+	}
+	if envHttpUrl := os.Getenv("CLANG_TIDY_CACHE_HTTP_URL"); len(envHttpUrl) > 0 {
+		if cfg.HttpConfig == nil {
+			cfg.HttpConfig = &caches.HttpConfiguration{}
+		}
+		cfg.HttpConfig.Url = envHttpUrl
+	}
+	// the token is also used by `clang-tidy-cache serve`, which has no URL
+	if envHttpToken := os.Getenv("CLANG_TIDY_CACHE_HTTP_TOKEN"); len(envHttpToken) > 0 {
+		if cfg.HttpConfig == nil {
+			cfg.HttpConfig = &caches.HttpConfiguration{}
+		}
+		cfg.HttpConfig.Token = envHttpToken
+	}
+	if cfg.HttpConfig != nil {
+		if envHttpTimeout := os.Getenv("CLANG_TIDY_CACHE_HTTP_TIMEOUT"); len(envHttpTimeout) > 0 {
+			if timeout, err := strconv.Atoi(envHttpTimeout); err == nil {
+				cfg.HttpConfig.Timeout = timeout
+			}
+		}
+	}
+	if envBoltPath := os.Getenv("CLANG_TIDY_CACHE_BOLT_PATH"); len(envBoltPath) > 0 {
+		if cfg.BoltConfig == nil {
+			cfg.BoltConfig = &caches.BoltConfiguration{}
+		}
+		cfg.BoltConfig.Path = envBoltPath
+	}
+	if envSqlitePath := os.Getenv("CLANG_TIDY_CACHE_SQLITE_PATH"); len(envSqlitePath) > 0 {
+		if cfg.SqliteConfig == nil {
+			cfg.SqliteConfig = &caches.SqliteConfiguration{}
+		}
+		cfg.SqliteConfig.Path = envSqlitePath
+	}
+	if envAzureContainer := os.Getenv("CLANG_TIDY_CACHE_AZURE_CONTAINER"); len(envAzureContainer) > 0 {
+		if cfg.AzureConfig == nil {
+			cfg.AzureConfig = &caches.AzureConfiguration{}
+		}
+		cfg.AzureConfig.Container = envAzureContainer
+	}
+	if cfg.AzureConfig != nil {
+		if envAzureConnection := os.Getenv("CLANG_TIDY_CACHE_AZURE_CONNECTION_STRING"); len(envAzureConnection) > 0 {
+			cfg.AzureConfig.ConnectionString = envAzureConnection
+		}
+		if envAzureUrl := os.Getenv("CLANG_TIDY_CACHE_AZURE_ACCOUNT_URL"); len(envAzureUrl) > 0 {
+			cfg.AzureConfig.AccountUrl = envAzureUrl
+		}
+	}
+	if envS3Bucket := os.Getenv("CLANG_TIDY_CACHE_S3_BUCKET"); len(envS3Bucket) > 0 {
+		if cfg.S3Config == nil {
+			cfg.S3Config = &caches.S3Configuration{}
+		}
+		cfg.S3Config.Bucket = envS3Bucket
+	}
+	if cfg.S3Config != nil {
+		if envS3Region := os.Getenv("CLANG_TIDY_CACHE_S3_REGION"); len(envS3Region) > 0 {
+			cfg.S3Config.Region = envS3Region
+		}
+		if envS3Endpoint := os.Getenv("CLANG_TIDY_CACHE_S3_ENDPOINT"); len(envS3Endpoint) > 0 {
+			cfg.S3Config.Endpoint = envS3Endpoint
+		}
+	}
+}
+
+// Parse the timeout of clang-tidy, a duration such as `120s` or `5m`. Zero
+// disables the timeout.
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("Invalid timeout %q, expected a duration such as 120s", value)
+	}
+	return timeout, nil
+}
+
+func loadConfiguration(wd string) (*Configuration, error) {
+	// lowest priority: built-in defaults
+	cfg := Configuration{ClangTidyPath: "clang-tidy"}
+
+	// higher priority: user config file
+	err := readConfigFile(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// even higher priority: project config file
+	err = readProjectConfigFile(&cfg, wd)
+	if err != nil {
+		return nil, err
+	}
+
+	// highest priority: environment variables
+	readConfigEnv(&cfg)
+
+	if len(cfg.Timeout) > 0 {
+		if cfg.timeout, err = parseTimeout(cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	// the commands that work on the filesystem cache directly use these settings
+	caches.SetFsConfiguration(cfg.FsConfiguration)
+	utils.SetLogLevel(cfg.LogLevel)
+	if err := utils.SetHashAlgorithm(cfg.Hash); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
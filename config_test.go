@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Set an environment variable for the rest of the test, an empty value unsets
+// it.
+func setEnv(t *testing.T, name string, value string) {
+	previous, existed := os.LookupEnv(name)
+	if len(value) == 0 {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, value)
+	}
+	t.Cleanup(func() {
+		if existed {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigurationPrecedence(t *testing.T) {
+	home := t.TempDir()
+	wd := t.TempDir()
+	setEnv(t, "HOME", home)
+	for _, name := range []string{"CLANG_TIDY_CACHE_DIR", "CLANG_TIDY_CACHE_BACKEND", "CLANG_TIDY_CACHE_LOG_LEVEL"} {
+		setEnv(t, name, "")
+	}
+	defer utils.SetLogLevel("warn")
+
+	// each step adds a source of the settings on top of the previous ones
+	steps := []struct {
+		name     string
+		apply    func()
+		cacheDir string
+		backend  string
+		logLevel string
+	}{
+		{"default", func() {}, "", "", ""},
+		{"user", func() {
+			writeFile(t, filepath.Join(home, ".ctcache", "config.json"), `{"cache_dir": "/user", "backend": "redis", "log_level": "info"}`)
+		}, "/user", "redis", "info"},
+		{"project", func() {
+			writeFile(t, filepath.Join(wd, PROJECT_CONFIG_FILE), "cache_dir: /project\nbackend: bolt\nlog_level: error\n")
+		}, "/project", "bolt", "error"},
+		{"env", func() {
+			setEnv(t, "CLANG_TIDY_CACHE_DIR", "/env")
+			setEnv(t, "CLANG_TIDY_CACHE_BACKEND", "sqlite")
+			setEnv(t, "CLANG_TIDY_CACHE_LOG_LEVEL", "warn")
+		}, "/env", "sqlite", "warn"},
+	}
+	for _, step := range steps {
+		step.apply()
+		cfg, err := loadConfiguration(wd)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if cfg.CacheDir != step.cacheDir {
+			t.Errorf("%s: got cache_dir %q, want %q", step.name, cfg.CacheDir, step.cacheDir)
+		}
+		if cfg.Backend != step.backend {
+			t.Errorf("%s: got backend %q, want %q", step.name, cfg.Backend, step.backend)
+		}
+		if cfg.LogLevel != step.logLevel {
+			t.Errorf("%s: got log_level %q, want %q", step.name, cfg.LogLevel, step.logLevel)
+		}
+	}
+}
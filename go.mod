@@ -4,5 +4,22 @@ go 1.15
 
 require (
 	cloud.google.com/go/storage v1.14.0
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.6.0
+	github.com/Azure/azure-sdk-for-go/sdk/azidentity v1.3.0
+	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v1.0.0
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/bradfitz/gomemcache v0.0.0-20230905024940-24af94b03874
+	github.com/gomodule/redigo v1.8.9
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
+	github.com/klauspost/compress v1.16.7
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/zeebo/blake3 v0.2.3
+	go.etcd.io/bbolt v1.3.7
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/sys v0.6.0
+	google.golang.org/api v0.40.0
+	sigs.k8s.io/yaml v1.3.0
 )
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"os/exec"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+	"github.com/google/shlex"
+)
+
+// Get the command to run on a cache hit or miss from the
+// CLANG_TIDY_CACHE_ON_HIT or CLANG_TIDY_CACHE_ON_MISS environment variable,
+// empty when it is not set.
+func getHook(hit bool) string {
+	if hit {
+		return os.Getenv("CLANG_TIDY_CACHE_ON_HIT")
+	}
+	return os.Getenv("CLANG_TIDY_CACHE_ON_MISS")
+}
+
+// Start the hook for the outcome of the lookup, if one is set, without waiting
+// for it. The command is split into words like a shell would, and gets the
+// digest and the target as its last arguments, as well as in
+// CLANG_TIDY_CACHE_DIGEST and CLANG_TIDY_CACHE_TARGET. Its output is discarded
+// and failures are only logged, so a hook can neither slow down nor change the
+// run.
+func runHook(hit bool, target string, digest []byte) {
+	command := getHook(hit)
+	if len(command) == 0 {
+		return
+	}
+	words, err := shlex.Split(command)
+	if err != nil || len(words) == 0 {
+		utils.Debugf("Ignoring the hook %q, which is not a command", command)
+		return
+	}
+
+	encodedDigest := hex.EncodeToString(digest)
+	cmd := exec.Command(words[0], append(words[1:], encodedDigest, target)...)
+	cmd.Env = append(os.Environ(), "CLANG_TIDY_CACHE_DIGEST="+encodedDigest, "CLANG_TIDY_CACHE_TARGET="+target)
+	if err := cmd.Start(); err != nil {
+		utils.Debugf("Error running the hook %q: %v", command, err)
+		return
+	}
+	// the hook may well outlive the wrapper, nothing waits for it
+	cmd.Process.Release()
+}
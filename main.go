@@ -1,92 +1,62 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
-	"os/user"
-	"path"
-	"path/filepath"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ejfitzgerald/clang-tidy-cache/caches"
 	"github.com/ejfitzgerald/clang-tidy-cache/clang"
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const VERSION = "0.7.0"
 
-type Configuration struct {
-	ClangTidyPath string                   `json:"clang_tidy_path"`
-	BaseDir       string                   `json:"base_dir"`
-	GcsConfig     *caches.GcsConfiguration `json:"gcs,omitempty"`
-}
-
-func readConfigFile(cfg *Configuration) error {
-	usr, err := user.Current()
-	if err != nil {
-		return err
-	}
+const DEFAULT_SERVE_ADDRESS = ":8080"
 
-	// define the configuration path
-	configPath := path.Join(usr.HomeDir, ".ctcache", "config.json")
+// Git commit of the build, set with `-ldflags "-X main.COMMIT=<sha>"`
+var COMMIT = ""
 
-	// missing config file is fine: we simply use the defaults or env vars
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return nil
-	}
-
-	// open the configuration file
-	jsonFile, err := os.Open(configPath)
-	if err != nil {
-		return err
+// Get the git commit of the build, falling back to the VCS information embedded by the Go toolchain.
+func getCommit() string {
+	if len(COMMIT) > 0 {
+		return COMMIT
 	}
-
-	// defer the closing of our jsonFile so that we can parse it later on
-	defer jsonFile.Close()
-
-	// read the contents
-	bytes, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(bytes, cfg)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func readConfigEnv(cfg *Configuration) {
-	if envPath := os.Getenv("CLANG_TIDY_CACHE_BINARY"); len(envPath) > 0 {
-		cfg.ClangTidyPath = envPath
-	}
-	if envBaseDir := os.Getenv("CLANG_TIDY_CACHE_BASEDIR"); len(envBaseDir) > 0 {
-		cfg.BaseDir = filepath.Clean(envBaseDir)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
 	}
+	return "unknown"
 }
 
-func loadConfiguration() (*Configuration, error) {
-	// lowest priority: built-in defaults
-	cfg := Configuration{ClangTidyPath: "clang-tidy"}
-
-	// higher priority: config file
-	err := readConfigFile(&cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	// highest priority: environment variables
-	readConfigEnv(&cfg)
-
-	return &cfg, nil
+func printVersion() {
+	fmt.Printf("clang-tidy-cache %s\n", VERSION)
+	fmt.Printf("commit: %s\n", getCommit())
+	fmt.Printf("go: %s\n", runtime.Version())
 }
 
-func streamOutput(file *os.File, closer io.ReadCloser, result *[]byte) {
+func streamOutput(file *os.File, closer io.ReadCloser, result *[]byte, wg *sync.WaitGroup) {
+	defer wg.Done()
 	defer closer.Close()
 
 	buffer := make([]byte, 1024)
@@ -104,36 +74,119 @@ func streamOutput(file *os.File, closer io.ReadCloser, result *[]byte) {
 	}
 }
 
-func runClangTidyCommand(cfg *Configuration, args []string) ([]byte, []byte, error) {
+// clang-tidy ran longer than the configured timeout and was killed
+var errTimedOut = errors.New("clang-tidy timed out")
+
+// Exit code of a run that timed out, the same as that of `timeout`
+const TIMEOUT_EXIT_CODE = 124
+
+// Target of an invocation that reads its source from stdin, e.g. of an editor integration
+const STDIN_TARGET = "-"
+
+// Run clang-tidy and return its stdout, stderr and exit code. A non-zero exit code is not an error: it is part
+// of the result, e.g. when using `-warnings-as-errors`. A run that takes longer than the timeout is killed along
+// with its children and returns `errTimedOut`. `stdin` is the input that the wrapper already read for a source read
+// from stdin, when it is nil clang-tidy gets the stdin of the wrapper.
+func runClangTidyCommand(ctx context.Context, cfg *Configuration, args []string, stdin []byte) ([]byte, []byte, int, error) {
 	cmd := exec.Command(cfg.ClangTidyPath, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	} else {
+		cmd.Stdin = os.Stdin
+	}
+	if cfg.timeout > 0 {
+		utils.SetProcessGroup(cmd)
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
 	stdout_buffer := []byte{}
 	stderr_buffer := []byte{}
 
-	// stream out the output of the command
-	go streamOutput(os.Stdout, stdout, &stdout_buffer)
-	go streamOutput(os.Stderr, stderr, &stderr_buffer)
-
 	err = cmd.Start()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
+	done := make(chan struct{})
+	timedOut := make(chan bool, 1)
+	if cfg.timeout > 0 {
+		go func() {
+			timer := time.NewTimer(cfg.timeout)
+			defer timer.Stop()
+			interrupted := ctx.Done()
+			for {
+				select {
+				case <-interrupted:
+					// in a process group of its own, clang-tidy does not get the interrupt of the terminal
+					utils.InterruptProcessGroup(cmd.Process)
+					interrupted = nil
+				case <-timer.C:
+					// processes started by clang-tidy would keep its output open, so they are killed as well
+					if err := utils.KillProcessGroup(cmd.Process); err != nil {
+						utils.Warnf("Error killing clang-tidy: %v", err)
+					}
+					timedOut <- true
+					return
+				case <-done:
+					timedOut <- false
+					return
+				}
+			}
+		}()
+	} else {
+		timedOut <- false
+	}
+
+	// stream out the output of the command, all reads need to be complete before waiting for the command
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go streamOutput(os.Stdout, stdout, &stdout_buffer, &wg)
+	go streamOutput(os.Stderr, stderr, &stderr_buffer, &wg)
+	wg.Wait()
+
 	err = cmd.Wait()
+	close(done)
+	if <-timedOut {
+		return nil, nil, 0, fmt.Errorf("%w after %v, killed it without caching the result", errTimedOut, cfg.timeout)
+	}
 	if err != nil {
-		return nil, nil, err
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return stdout_buffer, stderr_buffer, exitErr.ExitCode(), nil
+		}
+		return nil, nil, 0, err
 	}
 
-	return stdout_buffer, stderr_buffer, nil
+	return stdout_buffer, stderr_buffer, 0, nil
+}
+
+// Output of the LLVM crash handler, which clang-tidy prints when it crashes
+var crashMarkers = [][]byte{
+	[]byte("PLEASE submit a bug report"),
+	[]byte("Stack dump:"),
+	[]byte("LLVM ERROR:"),
+}
+
+// Check if clang-tidy crashed rather than reported diagnostics. It exits with 0
+// when there are no errors and 1 otherwise, e.g. for warnings treated as
+// errors. A negative exit code means that it was killed by a signal.
+func hasCrashed(exitCode int, stderr []byte) bool {
+	if exitCode < 0 || exitCode > 1 {
+		return true
+	}
+	for _, marker := range crashMarkers {
+		if bytes.Contains(stderr, marker) {
+			return true
+		}
+	}
+	return false
 }
 
 func shouldBypassCache(args []string) bool {
@@ -141,135 +194,601 @@ func shouldBypassCache(args []string) bool {
 		if arg == "-list-checks" || arg == "--version" {
 			return true
 		}
+
+		// applying fixes modifies the sources, which can not be replayed from the cache
+		if arg == "-fix" || arg == "--fix" || arg == "-fix-errors" || arg == "--fix-errors" {
+			utils.Infof("%s modifies the sources, bypassing the cache", arg)
+			return true
+		}
 	}
 
 	return false
 }
 
-func evaluateTidyCommand(cfg *Configuration, wd string, args []string, cache caches.Cacher) error {
-	bypassCache := shouldBypassCache(args)
+// Check if the output of the invocation is colored: when clang-tidy is run with `-use-color` and `NO_COLOR` is not
+// set, see https://no-color.org. Without the flag, clang-tidy does not color the output for the wrapper.
+func wantsColor(invocation *clang.TidyInvocation) bool {
+	return invocation.UseColor != nil && *invocation.UseColor && len(os.Getenv("NO_COLOR")) == 0
+}
+
+// Check if the cached result can be replayed for the invocation. An entry without colors can not be replayed for
+// an invocation with colors, unless there is no output on stdout that clang-tidy would color.
+func matchesColor(invocation *clang.TidyInvocation, result *caches.Result) bool {
+	return result.Colors || !wantsColor(invocation) || len(bytes.TrimSpace(result.Stdout)) == 0
+}
+
+// Write replayed output to the file, without colors unless the invocation wants them.
+func writeOutput(file *os.File, output []byte, colors bool) {
+	if !colors {
+		output = utils.StripAnsi(output)
+	}
+	file.Write(output)
+}
+
+// Decode the content of a cache entry for the invocation.
+func decodeCachedResult(invocation *clang.TidyInvocation, cacheContent []byte) *caches.Result {
+	result, ok := caches.DecodeResult(cacheContent)
+	if !ok {
+		// older versions stored the exported fixes when requested and the output otherwise
+		result = &caches.Result{}
+		if invocation.ExportFile != nil {
+			result.Fixes = cacheContent
+		} else {
+			result.Stdout = cacheContent
+		}
+	}
+	return result
+}
+
+// Replay a cached result as if clang-tidy had been run and return its exit code.
+func replayResult(invocation *clang.TidyInvocation, result *caches.Result) (int, error) {
+
+	if invocation.ExportFile != nil {
+		err := ioutil.WriteFile(*invocation.ExportFile, result.Fixes, 0644)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// the colors of entries of older versions, which stored the output as it was, are stripped as well
+	colors := wantsColor(invocation)
+	writeOutput(os.Stdout, result.Stdout, colors)
+	writeOutput(os.Stderr, result.Stderr, colors)
+
+	return result.ExitCode, nil
+}
+
+// Evaluate the clang-tidy command, from the cache when possible, and return the exit code of clang-tidy.
+func evaluateTidyCommand(ctx context.Context, cfg *Configuration, wd string, args []string, cache caches.Cacher) (int, error) {
+	began := time.Now()
+
+	// response files are expanded so that the cache sees the actual arguments
+	expandedArgs, err := clang.ExpandResponseFiles(args, wd)
+	if err != nil {
+		return 0, err
+	}
+	bypassCache := cfg.Disable || shouldBypassCache(expandedArgs)
 
 	// fingerprint
 	var fingerPrint []byte = nil
 	var invocation *clang.TidyInvocation = nil
+	// the cached result of a hit that is verified by running clang-tidy anyway
+	var verifiedResult *caches.Result = nil
+	// the source of an invocation that reads it from stdin, which is passed on to clang-tidy
+	var stdin []byte = nil
 
 	if !bypassCache {
 
 		// evaluate the commands that have been provided
-		other, err := clang.ParseTidyCommand(args)
+		other, err := clang.ParseTidyCommand(expandedArgs)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		invocation = other
 
-		// compute the finger print for the file
-		computedFingerPrint, err := caches.ComputeFingerPrint(cfg.ClangTidyPath, cfg.BaseDir, invocation, wd, args)
+		// compute the finger print for the file, or for the source read from stdin
+		var computedFingerPrint []byte
+		if invocation.TargetPath == STDIN_TARGET {
+			if stdin, err = ioutil.ReadAll(os.Stdin); err != nil {
+				return 0, err
+			}
+			computedFingerPrint, err = caches.ComputeStdinFingerPrint(cfg.ClangTidyPath, cfg.BaseDir, cfg.IgnoreWhitespace, invocation, wd, stdin)
+		} else {
+			computedFingerPrint, err = caches.ComputeFingerPrint(cfg.ClangTidyPath, cfg.BaseDir, cfg.IgnoreWhitespace, invocation, wd)
+		}
 		if err != nil {
-			return err
+			return 0, err
 		}
 		fingerPrint = computedFingerPrint
 
 		// evaluate if this function is has already been completed
-		cacheContent, err := cache.FindEntry(fingerPrint)
-		if err != nil {
-			return err
-		}
-		if invocation.ExportFile != nil {
-			f, err := os.Create(*invocation.ExportFile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			f.Write(cacheContent)
+		// an entry that can not be used is a miss, so clang-tidy runs again and the entry is replaced
+		cacheContent, found, err := cache.FindEntry(ctx, fingerPrint)
+		if errors.Is(err, caches.ErrCorrupt) {
+			utils.Warnf("Ignoring the corrupt cache entry for %s (%x): %v", invocation.TargetPath, fingerPrint, err)
+		} else if caches.IsSoftError(err) {
+			utils.Warnf("Error reading from the cache: %v", err)
+		} else if err != nil {
+			return 0, err
 		}
 
-		// this is "hopefully" the general case where we get a cache hit and this means that we need to do nothing
-		// further
-		if cacheContent != nil {
-			return nil
+		// this is "hopefully" the general case where we get a cache hit and this means that we only need to
+		// replay the result
+		if found && !caches.HasCurrentHash(cacheContent) {
+			utils.Debugf("Ignoring the entry for %s (%x) of another hash algorithm", invocation.TargetPath, fingerPrint)
+			found = false
+		}
+		var cachedResult *caches.Result
+		if found {
+			cachedResult = decodeCachedResult(invocation, cacheContent)
+		}
+		if found && !matchesColor(invocation, cachedResult) {
+			utils.Debugf("Ignoring the entry for %s (%x) without colors", invocation.TargetPath, fingerPrint)
+			found = false
+		}
+		runHook(found, invocation.TargetPath, fingerPrint)
+		if found && cfg.Verify {
+			utils.Debugf("Cache hit for %s (%x), verifying it", invocation.TargetPath, fingerPrint)
+			verifiedResult = cachedResult
+			found = false
 		}
+		if found {
+			utils.Debugf("Cache hit for %s (%x)", invocation.TargetPath, fingerPrint)
+			caches.RecordEvent(invocation.TargetPath, fingerPrint, true, len(cacheContent))
+			exitCode, err := replayResult(invocation, cachedResult)
+			if err == nil {
+				recordResult(invocation.TargetPath, fingerPrint, true, false, len(cacheContent), exitCode, time.Since(began))
+				pinResult(ctx, cfg, fingerPrint)
+			}
+			return exitCode, err
+		}
+		utils.Debugf("Cache miss for %s (%x)", invocation.TargetPath, fingerPrint)
 	}
 
 	// we need to run the command
-	stdout, _, err := runClangTidyCommand(cfg, args)
+	_, span := utils.StartSpan(ctx, "clang-tidy")
+	start := time.Now()
+	stdout, stderr, exitCode, err := runClangTidyCommand(ctx, cfg, args, stdin)
+	duration := time.Since(start).Round(time.Millisecond)
+	span.SetAttributes(attribute.Int("process.exit_code", exitCode))
+	utils.EndSpan(span, err)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	// a crash would be replayed on every later run, so it is not cached
+	crashed := hasCrashed(exitCode, stderr)
+	if crashed && !bypassCache {
+		utils.Warnf("clang-tidy crashed (exit code %d), the result is not cached", exitCode)
 	}
 
-	// if the file was clean then we should record this fact into the cache
-	if !bypassCache && fingerPrint != nil && invocation != nil {
-		content := []byte{}
+	// record the result into the cache, unless the run was interrupted
+	if !bypassCache && !crashed && fingerPrint != nil && invocation != nil && ctx.Err() == nil {
+		// the colors requested with `-use-color` are kept, they are stripped when replaying for an invocation
+		// without them; any other output is stored without colors, so that hits look the same wherever the entry
+		// was created
+		result := caches.Result{Stdout: utils.StripAnsi(stdout), Stderr: utils.StripAnsi(stderr), ExitCode: exitCode, Duration: duration}
+		if wantsColor(invocation) {
+			result.Stdout, result.Stderr, result.Colors = stdout, stderr, true
+		}
 		if invocation.ExportFile != nil {
-			content, err = ioutil.ReadFile(*invocation.ExportFile)
-			if err != nil {
-				return err
+			result.Fixes, err = ioutil.ReadFile(*invocation.ExportFile)
+			if err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		content, err := caches.EncodeResult(&result)
+		if err != nil {
+			return 0, err
+		}
+		if verifiedResult != nil {
+			differences := caches.CompareResults(verifiedResult, &result)
+			if len(differences) == 0 {
+				utils.Debugf("Verified the cache entry for %s (%x)", invocation.TargetPath, fingerPrint)
+				caches.RecordEvent(invocation.TargetPath, fingerPrint, true, len(content))
+				recordResult(invocation.TargetPath, fingerPrint, true, false, len(content), exitCode, time.Since(began))
+				pinResult(ctx, cfg, fingerPrint)
+				return exitCode, nil
+			}
+			// the wrong result has been served to every run with this digest
+			utils.Warnf("Cache collision for %s (%x): clang-tidy gave a different %s than the cached result, "+
+				"the fingerprint misses an input. Replacing the cache entry", invocation.TargetPath, fingerPrint, strings.Join(differences, ", "))
+			caches.RecordCollision()
+		}
+		// storing the result is best-effort: a failed save is simply a miss the next time
+		stored := false
+		if err := cache.SaveEntry(ctx, fingerPrint, content); err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				utils.Warnf("No space left for the cache, the result is not stored: %v", err)
+			} else {
+				utils.Warnf("Error storing the result in the cache: %v", err)
 			}
 		} else {
-			content = stdout
+			stored = true
+			pinResult(ctx, cfg, fingerPrint)
+		}
+		caches.RecordEvent(invocation.TargetPath, fingerPrint, false, len(content))
+		recordResult(invocation.TargetPath, fingerPrint, false, stored, len(content), exitCode, time.Since(began))
+	}
+
+	return exitCode, nil
+}
+
+// Prune the cache, the number of weeks can be omitted when it or the maximum age is set in the configuration.
+func runPrune(ctx context.Context, cfg *Configuration, args []string) error {
+	maxAge, err := cfg.GetMaxAge()
+	if err != nil {
+		return err
+	}
+	if maxAge == 0 {
+		maxAge = time.Duration(cfg.Prune.Weeks) * caches.WEEK
+	}
+	haveMaxAge := maxAge > 0
+	dryRun := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--dry-run" {
+			dryRun = true
+			continue
+		}
+
+		if arg == "--max-age" || strings.HasPrefix(arg, "--max-age=") {
+			value := strings.TrimPrefix(arg, "--max-age=")
+			if arg == "--max-age" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration < 0 {
+				return fmt.Errorf("Invalid maximum age %q", value)
+			}
+			maxAge = duration
+			haveMaxAge = true
+			continue
+		}
+
+		weeks, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
 		}
-		err = cache.SaveEntry(fingerPrint, content)
+		maxAge = time.Duration(weeks) * caches.WEEK
+		haveMaxAge = true
+	}
+
+	if !haveMaxAge {
+		fmt.Println("Usage: clang-tidy-cache prune <weeks> | --max-age <duration> [--dry-run]")
+		os.Exit(1)
+	}
+
+	_, pruner := caches.New(&cfg.Configuration)
+	return pruner.Prune(ctx, maxAge, dryRun)
+}
+
+// Print the digests that make up the fingerprint of the clang-tidy invocation,
+// so that the output for two invocations can be compared to find out why one
+// of them misses the cache.
+func runExplain(cfg *Configuration, wd string, args []string) error {
+	if len(args) == 0 {
+		fmt.Println("Usage: clang-tidy-cache --explain <clang-tidy arguments>")
+		os.Exit(1)
+	}
+
+	expandedArgs, err := clang.ExpandResponseFiles(args, wd)
+	if err != nil {
+		return err
+	}
+	invocation, err := clang.ParseTidyCommand(expandedArgs)
+	if err != nil {
+		return err
+	}
+	var parts *caches.FingerPrintParts
+	if invocation.TargetPath == STDIN_TARGET {
+		stdin, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			return err
 		}
+		parts, err = caches.ComputeStdinFingerPrintParts(cfg.ClangTidyPath, cfg.BaseDir, cfg.IgnoreWhitespace, invocation, wd, stdin)
+	} else {
+		parts, err = caches.ComputeFingerPrintParts(cfg.ClangTidyPath, cfg.BaseDir, cfg.IgnoreWhitespace, invocation, wd)
+	}
+	if err != nil {
+		return err
+	}
+
+	explain := func(name string, value interface{}) {
+		fmt.Printf("%-20s%v\n", name+":", value)
+	}
+	explain("Target", invocation.TargetPath)
+	explain("Preprocessed", hex.EncodeToString(parts.Preprocessed))
+	explain("Compile flags", hex.EncodeToString(parts.Compile))
+	explain("Configuration", hex.EncodeToString(parts.Config))
+	explain("clang-tidy binary", hex.EncodeToString(parts.Binary))
+	explain("clang-tidy version", hex.EncodeToString(parts.Version))
+	explain("Arguments", hex.EncodeToString(parts.Arguments))
+	explain("Export fixes", parts.ExportFixes)
+	explain("Base directory", cfg.BaseDir)
+	explain("Ignore whitespace", cfg.IgnoreWhitespace)
+	explain("Hash", parts.Hash)
+	explain("Fingerprint", hex.EncodeToString(parts.Sum()))
+	return nil
+}
+
+// Serve the configured cache over HTTP until interrupted.
+func runServe(ctx context.Context, cfg *Configuration, args []string) error {
+	address := DEFAULT_SERVE_ADDRESS
+	if len(args) == 1 {
+		address = args[0]
+	} else if len(args) > 1 {
+		fmt.Println("Usage: clang-tidy-cache serve [<address>]")
+		os.Exit(1)
+	}
+
+	token := ""
+	if cfg.HttpConfig != nil {
+		token = cfg.HttpConfig.Token
+	}
+	cache, _ := caches.New(&cfg.Configuration)
+	server := &http.Server{Addr: address, Handler: caches.NewServer(cache, token)}
+
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	utils.Infof("Serving the cache on %s", address)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Clear the cache, asking for confirmation unless `--yes` is given.
+func runClear(ctx context.Context, cfg *Configuration, args []string) error {
+	confirmed := false
+	for _, arg := range args {
+		if arg != "--yes" && arg != "-y" {
+			fmt.Println("Usage: clang-tidy-cache --clear [--yes]")
+			os.Exit(1)
+		}
+		confirmed = true
+	}
+
+	if !confirmed {
+		fmt.Printf("Remove all entries from %s? [y/N] ", cfg.GetFileSystemCachePath())
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Aborted")
+			return nil
+		}
+	}
+
+	return caches.Clear(ctx)
+}
+
+// Check the filesystem cache, returns the number of problems that remain.
+func runFsck(ctx context.Context, args []string) (int, error) {
+	repair := false
+	for _, arg := range args {
+		if arg != "--repair" {
+			fmt.Println("Usage: clang-tidy-cache --fsck [--repair]")
+			os.Exit(1)
+		}
+		repair = true
 	}
 
+	return caches.Check(ctx, repair)
+}
+
+// Pin the entry of the run when CLANG_TIDY_CACHE_PIN is set. Only entries of
+// the filesystem cache can be pinned, which includes the local cache of a
+// tiered cache.
+func pinResult(ctx context.Context, cfg *Configuration, digest []byte) {
+	if !cfg.Pin || cfg.IsReadOnly() {
+		return
+	}
+	missing, err := caches.Pin(ctx, []string{hex.EncodeToString(digest)}, true)
+	if err != nil {
+		utils.Warnf("Error pinning the cache entry %x: %v", digest, err)
+	} else if len(missing) > 0 {
+		utils.Warnf("The cache entry %x is not in the filesystem cache, it is not pinned", digest)
+	}
+}
+
+// Pin or unpin the given entries of the filesystem cache.
+func runPin(ctx context.Context, command string, digests []string) error {
+	if len(digests) == 0 {
+		fmt.Printf("Usage: clang-tidy-cache --%s <digest>...\n", command)
+		os.Exit(1)
+	}
+
+	missing, err := caches.Pin(ctx, digests, command == "pin")
+	if err != nil {
+		return err
+	}
+	for _, digest := range missing {
+		utils.Warnf("The cache entry %s is not in the filesystem cache", digest)
+	}
+	done := "Pinned"
+	if command == "unpin" {
+		done = "Unpinned"
+	}
+	fmt.Println(done, len(digests)-len(missing), "cache entries")
+	if len(missing) > 0 {
+		return fmt.Errorf("%d of the cache entries were not found", len(missing))
+	}
 	return nil
 }
 
+// Export the filesystem cache to an archive, or import one into it.
+func runArchive(ctx context.Context, command string, args []string) error {
+	if len(args) != 1 {
+		fmt.Printf("Usage: clang-tidy-cache --%s <archive>\n", command)
+		os.Exit(1)
+	}
+
+	if command == "export" {
+		return caches.Export(ctx, args[0])
+	}
+	return caches.Import(ctx, args[0])
+}
+
 func main() {
 	// we are only interested in the arguments for the command
 	args := os.Args[1:]
 
 	// handle version
 	if len(args) == 1 && args[0] == "version" {
-		fmt.Printf("clang-tidy-cache %s\n", VERSION)
+		printVersion()
 		os.Exit(0)
 	}
 
-	if len(args) >= 1 && args[0] == "prune" {
-		numWeeks, err := strconv.Atoi(args[1])
+	// find the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfiguration(wd)
+	if err != nil {
+		utils.Errorf("Failed to load configuration: %v", err)
+		os.Exit(1)
+	}
+
+	// a leading `--clang-tidy=<path>` picks the binary for this run and `--timeout=<duration>` limits how long it
+	// may run, they are not passed on to clang-tidy
+	for len(args) > 0 {
+		if strings.HasPrefix(args[0], "--clang-tidy=") {
+			cfg.ClangTidyPath = strings.TrimPrefix(args[0], "--clang-tidy=")
+		} else if strings.HasPrefix(args[0], "--timeout=") {
+			if cfg.timeout, err = parseTimeout(strings.TrimPrefix(args[0], "--timeout=")); err != nil {
+				utils.Errorf("%v", err)
+				os.Exit(1)
+			}
+		} else {
+			break
+		}
+		args = args[1:]
+	}
+
+	// an interrupt cancels the cache operations, clang-tidy itself receives the interrupt as well
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// the version of clang-tidy comes first, so that tools parsing it keep working through the wrapper
+	if len(args) == 1 && args[0] == "--version" {
+		_, _, exitCode, err := runClangTidyCommand(ctx, cfg, args, nil)
 		if err != nil {
-			fmt.Printf("Failed to prune the cache: %v\n", err)
+			utils.Warnf("Failed to get the version of clang-tidy: %v", err)
+		}
+		printVersion()
+		os.Exit(exitCode)
+	}
+
+	if len(args) == 1 && (args[0] == "stats" || args[0] == "--stats") {
+		if err := caches.PrintStats(); err != nil {
+			utils.Errorf("Failed to get the cache stats: %v", err)
 			os.Exit(1)
 		}
-		err = caches.Prune(numWeeks)
+		os.Exit(0)
+	}
+
+	if len(args) == 1 && (args[0] == "info" || args[0] == "--info") {
+		if err := caches.PrintInfo(); err != nil {
+			utils.Errorf("Failed to get the cache info: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(args) >= 1 && args[0] == "prune" {
+		if err := runPrune(ctx, cfg, args[1:]); err != nil {
+			utils.Errorf("Failed to prune the cache: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(args) >= 1 && args[0] == "--explain" {
+		if err := runExplain(cfg, wd, args[1:]); err != nil {
+			utils.Errorf("Failed to explain the fingerprint: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(args) >= 1 && args[0] == "serve" {
+		if err := runServe(ctx, cfg, args[1:]); err != nil {
+			utils.Errorf("Failed to serve the cache: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(args) >= 1 && (args[0] == "clear" || args[0] == "--clear") {
+		if err := runClear(ctx, cfg, args[1:]); err != nil {
+			utils.Errorf("Failed to clear the cache: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(args) >= 1 && (args[0] == "fsck" || args[0] == "--fsck") {
+		problems, err := runFsck(ctx, args[1:])
 		if err != nil {
-			fmt.Printf("Failed to prune the cache: %v\n", err)
+			utils.Errorf("Failed to check the cache: %v", err)
+			os.Exit(1)
+		}
+		if problems > 0 {
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
 
-	cfg, err := loadConfiguration()
-	if err != nil {
-		fmt.Printf("Failed to load configuration: %v\n", err)
-		os.Exit(1)
+	if len(args) >= 1 && (args[0] == "warm" || args[0] == "--warm") {
+		if err := runWarm(ctx, args[1:]); err != nil {
+			utils.Errorf("Failed to warm the cache: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	// find the working directory
-	wd, err := os.Getwd()
-	if err != nil {
-		os.Exit(1)
+	if len(args) >= 1 && (args[0] == "pin" || args[0] == "--pin" || args[0] == "unpin" || args[0] == "--unpin") {
+		command := strings.TrimPrefix(args[0], "--")
+		if err := runPin(ctx, command, args[1:]); err != nil {
+			utils.Errorf("Failed to %s the cache entries: %v", command, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	// attempt to load the Google Cloud cache
-	var cache caches.Cacher
-	if cfg.GcsConfig != nil {
-		candidate, err := caches.NewGcsCache(cfg.GcsConfig)
-		if err == nil {
-			cache = candidate
+	if len(args) >= 1 && (args[0] == "export" || args[0] == "--export" || args[0] == "import" || args[0] == "--import") {
+		command := strings.TrimPrefix(args[0], "--")
+		if err := runArchive(ctx, command, args[1:]); err != nil {
+			utils.Errorf("Failed to %s the cache: %v", command, err)
+			os.Exit(1)
 		}
+		os.Exit(0)
 	}
 
-	// if no other cache is configured then default to the FS cache
-	if cache == nil {
-		cache = caches.NewFsCache()
+	// the lookup, clang-tidy and the store are traced as children of the run
+	ctx, stopTracing := utils.StartTracing(ctx, "clang-tidy-cache")
+
+	// a disabled cache is not even created, so that no remote is contacted
+	var cache caches.Cacher
+	if !cfg.Disable {
+		cache, _ = caches.New(&cfg.Configuration)
 	}
 
 	// evaluate the clang tidy command
-	err = evaluateTidyCommand(cfg, wd, args, cache)
+	exitCode, err := evaluateTidyCommand(ctx, cfg, wd, args, cache)
+	stopTracing()
+	if errors.Is(err, errTimedOut) {
+		utils.Errorf("%v", err)
+		os.Exit(TIMEOUT_EXIT_CODE)
+	}
 	if err != nil {
-		fmt.Printf("Failed to get commands: %v\n", err)
+		utils.Errorf("Failed to get commands: %v", err)
 		os.Exit(1)
 	}
+	os.Exit(exitCode)
 }
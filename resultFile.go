@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+// Version of the records in the result file. Fields are only ever added, a
+// change to the existing ones increments it.
+const RESULT_RECORD_VERSION = 2
+
+// A line of the result file, about one run of the wrapper.
+type resultRecord struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Target  string    `json:"target"`
+	Digest  string    `json:"digest"`
+	Hit     bool      `json:"hit"`
+	// whether the result of a miss was saved to the cache, a miss is no longer
+	// assumed to be stored since version 2
+	Stored bool `json:"stored"`
+	// size of the cache entry that was replayed or stored
+	Bytes    int   `json:"bytes"`
+	ExitCode int   `json:"exit_code"`
+	Duration int64 `json:"duration_ms"`
+}
+
+// Get the path of the file that a record of every run is appended to from
+// the CLANG_TIDY_CACHE_RESULT_FILE environment variable, empty when it is not
+// set.
+func getResultFile() string {
+	return os.Getenv("CLANG_TIDY_CACHE_RESULT_FILE")
+}
+
+// Append the outcome of the run to the result file, if one is set. Every
+// record is a single line written with one append, so that concurrent runs
+// do not interleave their records.
+func recordResult(target string, digest []byte, hit bool, stored bool, size int, exitCode int, duration time.Duration) {
+	path := getResultFile()
+	if len(path) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(resultRecord{
+		Version:  RESULT_RECORD_VERSION,
+		Time:     time.Now(),
+		Target:   target,
+		Digest:   hex.EncodeToString(digest),
+		Hit:      hit,
+		Stored:   stored,
+		Bytes:    size,
+		ExitCode: exitCode,
+		Duration: duration.Milliseconds(),
+	})
+	if err != nil {
+		utils.Warnf("Error encoding the result record: %v", err)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		utils.Warnf("Error writing the result record: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		utils.Warnf("Error writing the result record: %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"regexp"
+)
+
+// Control sequences of ANSI terminals, e.g. `\x1b[1;31m` for bold red text
+var ansiSequence = regexp.MustCompile("\x1b\\[[0-9;?]*[ -/]*[@-~]")
+
+// StripAnsi removes the ANSI control sequences, such as colors, from the output.
+func StripAnsi(data []byte) []byte {
+	return ansiSequence.ReplaceAll(data, nil)
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by `TryLockFile()` when another holder has the lock.
+var ErrLocked = errors.New("The file is locked by another process")
+
+// FileLock is an advisory lock on a file, shared between processes.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile acquires an advisory lock on the file at path, creating the file if
+// needed with perm. The call blocks until the lock is available. An exclusive
+// lock keeps out all other holders while a shared lock only keeps out exclusive
+// holders.
+func LockFile(path string, perm os.FileMode, exclusive bool) (*FileLock, error) {
+	file, err := OpenFilePerm(path, os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+// TryLockFile acquires an exclusive lock on the file like `LockFile()`, but
+// fails with `ErrLocked` instead of blocking when the lock is already held.
+func TryLockFile(path string, perm os.FileMode) (*FileLock, error) {
+	file, err := OpenFilePerm(path, os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tryLockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	defer l.file.Close()
+	return unlockFile(l.file)
+}
@@ -2,8 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // FindInParents searches for a file named filename in searchDir or any of it's
@@ -26,3 +30,136 @@ func findInParentsOrig(origSearchDir string, searchDir string, filename string)
 	}
 	return findInParentsOrig(origSearchDir, parentDir, filename)
 }
+
+// HomeDir gets the home directory of the current user from the HOME
+// environment variable, falling back to looking up the user when it is not
+// set.
+func HomeDir() (string, error) {
+	if home := os.Getenv("HOME"); len(home) > 0 {
+		return home, nil
+	}
+	if usr, err := user.Current(); err == nil && len(usr.HomeDir) > 0 {
+		return usr.HomeDir, nil
+	}
+	return "", fmt.Errorf("Failed to find the home directory of the current user")
+}
+
+// TEMP_SUFFIX is the suffix of the temporary files created by WriteFileAtomic.
+const TEMP_SUFFIX = ".tmp"
+
+// WriteFileAtomic writes data to the file at path, like ioutil.WriteFile, but
+// goes through a temporary file in the same directory which is renamed into
+// place. Readers therefore see either the old or the new content, never a
+// partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomicFunc(path, perm, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// WriteFileAtomicFunc is like WriteFileAtomic, but the content is written to
+// the temporary file by write, e.g. to stream it.
+func WriteFileAtomicFunc(path string, perm os.FileMode, write func(*os.File) error) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*"+TEMP_SUFFIX)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	err = write(tmpFile)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// MkdirAllPerm creates the directory at path along with any missing parents,
+// like os.MkdirAll, but sets perm on the directories it creates regardless of
+// the umask.
+func MkdirAllPerm(path string, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", path)
+		}
+		return nil
+	}
+
+	if parent := filepath.Dir(path); parent != path {
+		if err := MkdirAllPerm(parent, perm); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(path, perm); err != nil {
+		// another process may have created it in the meantime
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+// OpenFilePerm opens the file at path like os.OpenFile with os.O_CREATE, but
+// sets perm on the file when it is created regardless of the umask.
+func OpenFilePerm(path string, flag int, perm os.FileMode) (*os.File, error) {
+	file, err := os.OpenFile(path, flag|os.O_CREATE|os.O_EXCL, perm)
+	if os.IsExist(err) {
+		return os.OpenFile(path, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a human readable size such as `5GB` or `512MB` into a number
+// of bytes. The units are powers of 1024, a number without unit is in bytes.
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
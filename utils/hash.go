@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// The algorithm used when none is configured, entries of earlier versions were digested with it
+const DEFAULT_HASH = "sha256"
+
+// Both algorithms produce digests of 32 bytes, so the digests fit the same cache keys
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+}
+
+var hashAlgorithm = DEFAULT_HASH
+
+// ParseHashAlgorithm checks the name of an algorithm for the digests of the
+// fingerprint, `sha256` or `blake3`, and returns it in lower case. An empty
+// name selects DEFAULT_HASH.
+func ParseHashAlgorithm(name string) (string, error) {
+	name = strings.ToLower(name)
+	if len(name) == 0 {
+		return DEFAULT_HASH, nil
+	}
+	if _, ok := hashAlgorithms[name]; !ok {
+		return "", fmt.Errorf("Unknown hash algorithm %q", name)
+	}
+	return name, nil
+}
+
+// SetHashAlgorithm sets the algorithm of the digests of the fingerprint by
+// name, see `ParseHashAlgorithm()`.
+func SetHashAlgorithm(name string) error {
+	name, err := ParseHashAlgorithm(name)
+	if err != nil {
+		return err
+	}
+	hashAlgorithm = name
+	return nil
+}
+
+// HashAlgorithm gets the name of the algorithm set by `SetHashAlgorithm()`.
+func HashAlgorithm() string {
+	return hashAlgorithm
+}
+
+// NewHashOf creates a hash of the named algorithm, as returned by
+// `ParseHashAlgorithm()`.
+func NewHashOf(name string) hash.Hash {
+	return hashAlgorithms[name]()
+}
+
+// HashOf computes the digest of the data with the named algorithm.
+func HashOf(name string, data []byte) []byte {
+	hasher := NewHashOf(name)
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package utils
+
+// InodeUsage gets the total and the free number of inodes of the filesystem
+// that the path is on, which is only supported on Linux and macOS.
+func InodeUsage(path string) (uint64, uint64, bool) {
+	return 0, 0, false
+}
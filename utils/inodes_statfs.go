@@ -0,0 +1,18 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package utils
+
+import (
+	"syscall"
+)
+
+// InodeUsage gets the total and the free number of inodes of the filesystem
+// that the path is on. Returns false when they can not be determined.
+func InodeUsage(path string) (uint64, uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil || stat.Files == 0 {
+		return 0, 0, false
+	}
+	return uint64(stat.Files), uint64(stat.Ffree), true
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LOG_ERROR LogLevel = iota
+	LOG_WARN
+	LOG_INFO
+	LOG_DEBUG
+)
+
+var logLevelNames = map[LogLevel]string{
+	LOG_ERROR: "error",
+	LOG_WARN:  "warn",
+	LOG_INFO:  "info",
+	LOG_DEBUG: "debug",
+}
+
+var logLevel = getLogLevel()
+
+// getLogLevel gets the level of the messages to log from the
+// CLANG_TIDY_CACHE_LOG_LEVEL environment variable: error, warn, info or debug.
+// It defaults to warn.
+func getLogLevel() LogLevel {
+	name := strings.ToLower(os.Getenv("CLANG_TIDY_CACHE_LOG_LEVEL"))
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			return level
+		}
+	}
+	return LOG_WARN
+}
+
+// SetLogLevel sets the level of the messages to log by name, unless it is set
+// by the CLANG_TIDY_CACHE_LOG_LEVEL environment variable.
+func SetLogLevel(name string) {
+	if len(os.Getenv("CLANG_TIDY_CACHE_LOG_LEVEL")) > 0 {
+		return
+	}
+	for level, levelName := range logLevelNames {
+		if strings.ToLower(name) == levelName {
+			logLevel = level
+		}
+	}
+}
+
+// Logf writes the message to stderr, so it does not mix with the output of
+// clang-tidy, if the level is enabled.
+func Logf(level LogLevel, format string, args ...interface{}) {
+	if level > logLevel {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "clang-tidy-cache [%s] %s\n", logLevelNames[level], fmt.Sprintf(format, args...))
+}
+
+func Errorf(format string, args ...interface{}) {
+	Logf(LOG_ERROR, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	Logf(LOG_WARN, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	Logf(LOG_INFO, format, args...)
+}
+
+func Debugf(format string, args ...interface{}) {
+	Logf(LOG_DEBUG, format, args...)
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup starts the command in a process group of its own, so that
+// `KillProcessGroup()` reaches the processes it starts as well.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// KillProcessGroup kills the process started with `SetProcessGroup()` along
+// with everything else in its process group.
+func KillProcessGroup(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
+
+// InterruptProcessGroup passes an interrupt on to the process group of a
+// process started with `SetProcessGroup()`, which no longer gets the
+// interrupts of the terminal.
+func InterruptProcessGroup(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGINT)
+}
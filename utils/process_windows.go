@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// SetProcessGroup does nothing on Windows, where `KillProcessGroup()` finds
+// the processes started by the command through their parent instead. The
+// command stays in the console process group of this process, so it still
+// gets Ctrl+C.
+func SetProcessGroup(cmd *exec.Cmd) {}
+
+// KillProcessGroup kills the process along with the processes it started.
+func KillProcessGroup(process *os.Process) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(process.Pid)).Run(); err != nil {
+		return process.Kill()
+	}
+	return nil
+}
+
+// InterruptProcessGroup does nothing on Windows, since the process gets
+// Ctrl+C from the console itself.
+func InterruptProcessGroup(process *os.Process) error {
+	return nil
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TRACER_NAME = "github.com/ejfitzgerald/clang-tidy-cache"
+
+// Spans that are not exported within this time are dropped, so that an
+// unreachable collector does not hold up the build
+const TRACING_SHUTDOWN_TIMEOUT = 2 * time.Second
+
+// IsTracingEnabled checks if spans should be exported, which is enabled by
+// setting the OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// environment variable.
+func IsTracingEnabled() bool {
+	return len(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) > 0 || len(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")) > 0
+}
+
+// The W3C trace context of a parent process, in the TRACEPARENT and TRACESTATE
+// environment variables
+type envCarrier struct{}
+
+func envName(key string) string {
+	return strings.ToUpper(key)
+}
+
+func (envCarrier) Get(key string) string {
+	return os.Getenv(envName(key))
+}
+
+func (envCarrier) Set(key string, value string) {
+	os.Setenv(envName(key), value)
+}
+
+func (envCarrier) Keys() []string {
+	return []string{"traceparent", "tracestate"}
+}
+
+// StartTracing sets up the export of spans over OTLP/HTTP when tracing is
+// enabled, configured by the standard OTEL_EXPORTER_OTLP_* environment
+// variables, and starts the span of the whole run. The span is a child of the
+// span in TRACEPARENT, if it is set, so that it appears in the trace of the
+// build. The returned function ends the span and flushes the spans, it has to
+// be called before the process exits.
+func StartTracing(ctx context.Context, name string) (context.Context, func()) {
+	if !IsTracingEnabled() {
+		return ctx, func() {}
+	}
+
+	// failed exports are not shown by default, the output of clang-tidy must not change
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		Debugf("Tracing: %v", err)
+	}))
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		Warnf("Failed to set up tracing: %v", err)
+		return ctx, func() {}
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String("clang-tidy-cache")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		Warnf("Invalid tracing resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	ctx = propagation.TraceContext{}.Extract(ctx, envCarrier{})
+	ctx, span := StartSpan(ctx, name)
+	return ctx, func() {
+		span.End()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), TRACING_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			Debugf("Failed to export the spans: %v", err)
+		}
+	}
+}
+
+// StartSpan starts a span, which is only recorded once `StartTracing()` set
+// up tracing.
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TRACER_NAME).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan ends the span, marking it as failed with the error if there is one.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
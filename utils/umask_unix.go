@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+var umaskOnce sync.Once
+var umask os.FileMode
+
+// Umask gets the file mode creation mask of the process. The mask can only be
+// read by setting it, so it is read once and restored right away.
+func Umask() os.FileMode {
+	umaskOnce.Do(func() {
+		mask := syscall.Umask(0)
+		syscall.Umask(mask)
+		umask = os.FileMode(mask)
+	})
+	return umask
+}
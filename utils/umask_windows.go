@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"os"
+)
+
+// Umask gets the file mode creation mask of the process, which does not exist
+// on Windows.
+func Umask() os.FileMode {
+	return 0
+}
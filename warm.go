@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ejfitzgerald/clang-tidy-cache/clang"
+	"github.com/ejfitzgerald/clang-tidy-cache/utils"
+)
+
+func printWarmUsage() {
+	fmt.Println("Usage: clang-tidy-cache --warm <compile_commands.json> [-j <jobs>] [-- <clang-tidy arguments>]")
+	os.Exit(1)
+}
+
+// Run clang-tidy through the cache for every entry of the compilation
+// database, e.g. in a nightly job that fills a shared cache. Each entry runs as
+// `clang-tidy-cache -p <database directory> <file>` in the directory of the
+// entry, in the same way as `run-clang-tidy`, so it takes the path of a normal
+// run. The output of clang-tidy is discarded, only the number of hits and of
+// newly cached entries is printed.
+func runWarm(ctx context.Context, args []string) error {
+	jobs := runtime.NumCPU()
+	databasePath := ""
+	extraArgs := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			extraArgs = args[i+1:]
+			i = len(args)
+		case strings.HasPrefix(arg, "-j"):
+			value := strings.TrimPrefix(arg, "-j")
+			if len(value) == 0 && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			var err error
+			if jobs, err = strconv.Atoi(value); err != nil || jobs < 1 {
+				printWarmUsage()
+			}
+		case len(databasePath) == 0 && !strings.HasPrefix(arg, "-"):
+			databasePath = arg
+		default:
+			printWarmUsage()
+		}
+	}
+	if len(databasePath) == 0 {
+		printWarmUsage()
+	}
+
+	databasePath, err := filepath.Abs(databasePath)
+	if err != nil {
+		return err
+	}
+	db, err := clang.ReadDatabase(databasePath)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", databasePath, err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// the runs report their outcome in a result file of their own
+	results, err := ioutil.TempFile("", "clang-tidy-cache-warm-*.jsonl")
+	if err != nil {
+		return err
+	}
+	results.Close()
+	defer os.Remove(results.Name())
+	env := append(os.Environ(), "CLANG_TIDY_CACHE_RESULT_FILE="+results.Name())
+
+	entries := make(chan clang.DatabaseEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				// the file is passed as the database names it, which is how the entry of the target is found
+				cmdArgs := append([]string{"-p", filepath.Dir(databasePath)}, extraArgs...)
+				cmd := exec.CommandContext(ctx, executable, append(cmdArgs, entry.File)...)
+				cmd.Dir = entry.Directory
+				cmd.Env = env
+				// a non-zero exit code is the result of clang-tidy rather than an error of the warmup
+				if err := cmd.Run(); err != nil {
+					utils.Debugf("Warming %s: %v", entry.File, err)
+				}
+			}
+		}()
+	}
+
+	utils.Infof("Warming the cache with the %d entries of %s, running %d jobs", len(db), databasePath, jobs)
+feed:
+	for _, entry := range db {
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(entries)
+	wg.Wait()
+
+	hits, stored, err := summarizeWarm(results.Name())
+	if err != nil {
+		return err
+	}
+	fmt.Println("Entries:     ", len(db))
+	fmt.Println("Hits:        ", hits)
+	fmt.Println("Newly cached:", stored)
+	// e.g. crashes of clang-tidy, entries that bypass the cache, or results that could not be saved
+	fmt.Println("Not cached:  ", len(db)-hits-stored)
+	return ctx.Err()
+}
+
+// Count the hits and the stored results among the records of the result file,
+// which are appended to the result file of the user if one is set.
+func summarizeWarm(path string) (int, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if userPath := getResultFile(); len(userPath) > 0 {
+		if err := appendFile(userPath, data); err != nil {
+			utils.Warnf("Error writing the result records: %v", err)
+		}
+	}
+
+	hits, stored := 0, 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record resultRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if record.Hit {
+			hits++
+		} else if record.Stored {
+			stored++
+		}
+	}
+	return hits, stored, scanner.Err()
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	return err
+}